@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/kdudkov/mb_gate/modbus"
 	"os"
+	"sort"
 )
 
 func main() {
@@ -13,10 +14,16 @@ func main() {
 	var dev = flag.Int("dev", 0, "device id")
 	var addr = flag.Int("addr", 0, "address")
 	var num = flag.Int("num", 1, "number of values")
+	var code = flag.Int("code", modbus.ReadDeviceIdBasic, "device identification code (1 - basic, 2 - regular, 3 - extended)")
+	var rtu = flag.Bool("rtu", false, "send rtu frames over tcp, e.g. to ethernet to rs485 converter")
+	var speed = flag.Int("speed", 19200, "bus speed for rtu over tcp timings")
 	//var data = flag.String("data", "", "data to send")
 
 	flag.Parse()
 	s := modbus.NewClient(*host)
+	if *rtu {
+		s = modbus.NewRtuOverTcpClient(*host, *speed)
+	}
 	err := s.Connect()
 	if err != nil {
 		fmt.Printf("error: %s", err.Error())
@@ -69,6 +76,85 @@ func main() {
 			fmt.Printf("  %d: %#x\n", *addr+i, res[i])
 		}
 
+	case 7:
+		v, err := s.ReadExceptionStatus(byte(*dev))
+
+		if err != nil {
+			fmt.Printf("error: %s", err.Error())
+			return
+		}
+
+		fmt.Printf("  exception status: %#.2x\n", v)
+
+	case 8:
+		if v, err := s.DiagnosticCounter(byte(*dev), modbus.DiagReturnDiagnosticRegister); err == nil {
+			fmt.Printf("  diagnostic register: %#.4x\n", v)
+		} else {
+			fmt.Printf("  diagnostic register: error %s\n", err.Error())
+		}
+
+		for _, c := range modbus.DiagCounters {
+			if v, err := s.DiagnosticCounter(byte(*dev), c.SubFunction); err == nil {
+				fmt.Printf("  %s: %d\n", c.Name, v)
+			} else {
+				fmt.Printf("  %s: error %s\n", c.Name, err.Error())
+			}
+		}
+
+	case 11:
+		status, count, err := s.GetComEventCounter(byte(*dev))
+
+		if err != nil {
+			fmt.Printf("error: %s", err.Error())
+			return
+		}
+
+		fmt.Printf("  status: %#.4x\n", status)
+		fmt.Printf("  event count: %d\n", count)
+
+	case 12:
+		log, err := s.GetComEventLog(byte(*dev))
+
+		if err != nil {
+			fmt.Printf("error: %s", err.Error())
+			return
+		}
+
+		fmt.Printf("  status: %#.4x\n", log.Status)
+		fmt.Printf("  event count: %d\n", log.EventCount)
+		fmt.Printf("  message count: %d\n", log.MessageCount)
+		fmt.Printf("  events: % x\n", log.Events)
+
+	case 17:
+		r, err := s.ReportSlaveId(byte(*dev))
+
+		if err != nil {
+			fmt.Printf("error: %s", err.Error())
+			return
+		}
+
+		fmt.Printf("  slave id: %#.2x\n", r.SlaveId)
+		fmt.Printf("  run: %v\n", r.RunIndicator)
+		fmt.Printf("  additional: %q\n", r.Additional)
+
+	case 43:
+		res, err := s.ReadDeviceIdentification(byte(*dev), byte(*code))
+
+		if err != nil {
+			fmt.Printf("error: %s", err.Error())
+			return
+		}
+
+		ids := make([]int, 0, len(res))
+		for id := range res {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+
+		for _, id := range ids {
+			fmt.Printf("  %#.2x: %s\n", id, res[byte(id)])
+		}
+
 	default:
 		fmt.Println("functions:")
 		fmt.Println("  1 (0x01) — Read Coils.")
@@ -77,6 +163,12 @@ func main() {
 		fmt.Println("  4 (0x04) — Read Input Registers.")
 		fmt.Println("  5 (0x05) — Write Single Coil.")
 		fmt.Println("  6 (0x06) — Write Single Register.")
+		fmt.Println("  7 (0x07) — Read Exception Status.")
+		fmt.Println("  8 (0x08) — Diagnostics (counters).")
+		fmt.Println(" 11 (0x0B) — Get Comm Event Counter.")
+		fmt.Println(" 12 (0x0C) — Get Comm Event Log.")
+		fmt.Println(" 17 (0x11) — Report Slave ID.")
+		fmt.Println(" 43 (0x2B) — Read Device Identification.")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdudkov/mb_gate/modbus"
+)
+
+// Bus is a serial line or modbus tcp upstream with its own job queue and workers.
+type Bus struct {
+	Name      string
+	Transport modbus.Transport
+	Jobs      chan *Job
+	// Units are unit ids routed to the bus, all unit ids if empty
+	Units []UnitRange
+	// TcpPort makes the bus serve requests from this listen port only, 0 for any port
+	TcpPort int
+	// Workers is the number of jobs executed at the same time, serial bus has only one
+	Workers int
+	// Timeout is the answer timeout of the transport, the job deadline is made of it
+	Timeout time.Duration
+}
+
+func NewBus(name string, transport modbus.Transport) *Bus {
+	return &Bus{Name: name, Transport: transport, Jobs: make(chan *Job, 10), Workers: 1, Timeout: transportTimeout(transport)}
+}
+
+// transportTimeout returns the answer timeout of the transport, readTimeout if it is not known.
+func transportTimeout(transport modbus.Transport) time.Duration {
+	switch t := transport.(type) {
+	case *modbus.SerialPort:
+		return t.Timeout
+	case *modbus.TcpUpstream:
+		return t.Timeout
+	default:
+		return readTimeout
+	}
+}
+
+// UnitRange is unit id range, both ends included.
+type UnitRange struct {
+	From, To byte
+}
+
+// serves returns true if requests to the unit from the listen port can be routed to the bus.
+func (b *Bus) serves(port int, unitId byte) bool {
+	if b.TcpPort != 0 && b.TcpPort != port {
+		return false
+	}
+
+	if len(b.Units) == 0 {
+		return true
+	}
+
+	for _, r := range b.Units {
+		if unitId >= r.From && unitId <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// specificity is to choose the bus when several can serve the request,
+// listen port is more specific than unit ids and both are more specific than nothing.
+func (b *Bus) specificity() int {
+	n := 0
+	if b.TcpPort != 0 {
+		n += 2
+	}
+	if len(b.Units) > 0 {
+		n++
+	}
+	return n
+}
+
+func (b *Bus) String() string {
+	return b.Name
+}
+
+// busName names the bus by its transport and routing, buses passing checkRoutes get different names.
+func busName(b *Bus) string {
+	name := fmt.Sprint(b.Transport)
+	if b.TcpPort != 0 {
+		name += fmt.Sprintf(" tcp_port=%d", b.TcpPort)
+	}
+	if len(b.Units) > 0 {
+		name += " units=" + formatUnits(b.Units)
+	}
+	return name
+}
+
+// busNames returns comma separated names of all buses.
+func (app *App) busNames() string {
+	names := make([]string, len(app.buses))
+	for i, b := range app.buses {
+		names[i] = b.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// route returns the bus for the request to the unit from the listen port, nil if there is no such bus.
+func (app *App) route(port int, unitId byte) *Bus {
+	var res *Bus
+
+	for _, b := range app.buses {
+		if b.serves(port, unitId) && (res == nil || b.specificity() > res.specificity()) {
+			res = b
+		}
+	}
+	return res
+}
+
+// checkRoutes returns error if two buses of the same specificity can serve the same request,
+// the first of them would always win.
+func (app *App) checkRoutes() error {
+	for i, a := range app.buses {
+		for _, b := range app.buses[i+1:] {
+			if a.TcpPort != b.TcpPort || len(a.Units) > 0 != (len(b.Units) > 0) {
+				continue
+			}
+
+			if len(a.Units) == 0 || overlaps(a.Units, b.Units) {
+				return fmt.Errorf("buses %s and %s serve the same unit ids on tcp port %d", a, b, a.TcpPort)
+			}
+		}
+	}
+	return nil
+}
+
+func overlaps(a, b []UnitRange) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.From <= y.To && y.From <= x.To {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddBus adds the bus to the gateway, it must be called before Run.
+func (app *App) AddBus(bus *Bus) {
+	app.buses = append(app.buses, bus)
+}
+
+// startWorkers starts worker for every bus.
+func (app *App) startWorkers(wg *sync.WaitGroup) {
+	for _, b := range app.buses {
+		for i := 0; i < b.Workers; i++ {
+			wg.Add(1)
+			go app.WorkerLoop(b, wg)
+		}
+	}
+}
+
+// tcpPorts returns all listen ports: the main one and ones of the buses.
+func (app *App) tcpPorts() []int {
+	ports := []int{app.tcpPort}
+
+	for _, b := range app.buses {
+		if b.TcpPort != 0 && !containsInt(ports, b.TcpPort) {
+			ports = append(ports, b.TcpPort)
+		}
+	}
+	return ports
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUnits parses plus separated unit ids and ranges, e.g. 1-10+20.
+func parseUnits(s string) ([]UnitRange, error) {
+	var res []UnitRange
+
+	for _, p := range strings.Split(s, "+") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(p, "-")
+		if !isRange {
+			to = from
+		}
+
+		f, err := strconv.ParseUint(from, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := strconv.ParseUint(to, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		if f > t {
+			return nil, fmt.Errorf("bad unit range %s", p)
+		}
+		res = append(res, UnitRange{From: byte(f), To: byte(t)})
+	}
+
+	return res, nil
+}
+
+// formatUnits formats unit ranges as parseUnits parses them.
+func formatUnits(units []UnitRange) string {
+	res := make([]string, len(units))
+	for i, r := range units {
+		if r.From == r.To {
+			res[i] = strconv.Itoa(int(r.From))
+		} else {
+			res[i] = fmt.Sprintf("%d-%d", r.From, r.To)
+		}
+	}
+	return strings.Join(res, "+")
+}
+
+// BusConfig is serial bus settings from -bus flag.
+type BusConfig struct {
+	Port       string
+	Speed      int
+	Ascii      bool
+	Echo       bool
+	Turnaround time.Duration
+	Units      []UnitRange
+	TcpPort    int
+}
+
+// parseBus parses comma separated bus options, e.g. port=/dev/ttyUSB1,speed=9600,units=1-10+20,tcp_port=1503,ascii,echo.
+// Options not given are taken from def.
+func parseBus(s string, def BusConfig) (BusConfig, error) {
+	c := def
+
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		k, v, _ := strings.Cut(opt, "=")
+
+		var err error
+		switch k {
+		case "port":
+			c.Port = v
+		case "speed":
+			c.Speed, err = strconv.Atoi(v)
+		case "ascii":
+			c.Ascii = true
+		case "echo":
+			c.Echo = true
+		case "turnaround":
+			c.Turnaround, err = time.ParseDuration(v)
+		case "units":
+			c.Units, err = parseUnits(v)
+		case "tcp_port":
+			c.TcpPort, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown bus option %s", k)
+		}
+
+		if err != nil {
+			return c, err
+		}
+	}
+
+	if c.Port == "" {
+		return c, fmt.Errorf("no port for bus %s", s)
+	}
+
+	return c, nil
+}
+
+// UpstreamConfig is modbus tcp upstream settings from -upstream flag.
+type UpstreamConfig struct {
+	Addr    string
+	Timeout time.Duration
+	// Conns is the number of connections and workers
+	Conns   int
+	UnitMap map[byte]byte
+	Units   []UnitRange
+	TcpPort int
+}
+
+// parseUpstream parses comma separated upstream options, e.g. addr=10.0.0.2:502,units=30-39,unit_map=30:1+31:2,timeout=500ms,conns=2.
+func parseUpstream(s string) (UpstreamConfig, error) {
+	c := UpstreamConfig{Timeout: time.Second, Conns: 1, UnitMap: make(map[byte]byte)}
+
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		k, v, _ := strings.Cut(opt, "=")
+
+		var err error
+		switch k {
+		case "addr":
+			c.Addr = v
+		case "timeout":
+			c.Timeout, err = time.ParseDuration(v)
+			if err == nil && c.Timeout <= 0 {
+				err = fmt.Errorf("bad timeout value %s", v)
+			}
+		case "conns":
+			c.Conns, err = strconv.Atoi(v)
+			if err == nil && c.Conns < 1 {
+				err = fmt.Errorf("bad conns value %d", c.Conns)
+			}
+		case "unit_map":
+			c.UnitMap, err = parseUnitMap(v)
+		case "units":
+			c.Units, err = parseUnits(v)
+		case "tcp_port":
+			c.TcpPort, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown upstream option %s", k)
+		}
+
+		if err != nil {
+			return c, err
+		}
+	}
+
+	if c.Addr == "" {
+		return c, fmt.Errorf("no addr for upstream %s", s)
+	}
+
+	return c, nil
+}
+
+// parseUnitMap parses plus separated unit id pairs, e.g. 30:1+31:2.
+func parseUnitMap(s string) (map[byte]byte, error) {
+	res := make(map[byte]byte)
+
+	for _, p := range strings.Split(s, "+") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		from, to, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad unit map %s", p)
+		}
+
+		ids, err := parseIds(from + "," + to)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ids) != 2 {
+			return nil, fmt.Errorf("bad unit map %s", p)
+		}
+		res[ids[0]] = ids[1]
+	}
+
+	return res, nil
+}
+
+// busFlags is repeatable flag, for -bus and -upstream.
+type busFlags []string
+
+func (f *busFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *busFlags) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
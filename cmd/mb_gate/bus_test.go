@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kdudkov/mb_gate/modbus"
+)
+
+// unitBus answers read holding registers from any unit with its own id as the value.
+func unitBus(id uint16) *modbus.PipeTransport {
+	return modbus.NewPipe(func(pdu *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+		return &modbus.ProtocolDataUnit{SlaveId: pdu.SlaveId, FunctionCode: pdu.FunctionCode, Data: []byte{2, 0, byte(id)}}
+	})
+}
+
+func TestBusRouting(t *testing.T) {
+	app := NewApp(unitBus(1), 0, 1502, zap.NewNop().Sugar())
+	app.buses[0].Units = []UnitRange{{From: 1, To: 10}}
+
+	second := NewBus("second", unitBus(2))
+	second.Units = []UnitRange{{From: 11, To: 20}, {From: 30, To: 30}}
+	app.AddBus(second)
+
+	third := NewBus("third", unitBus(3))
+	third.TcpPort = 1503
+	app.AddBus(third)
+
+	fourth := NewBus("fourth", unitBus(4))
+	fourth.TcpPort = 1504
+	fourth.Units = []UnitRange{{From: 40, To: 49}}
+	app.AddBus(fourth)
+
+	if err := app.checkRoutes(); err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	wg := new(sync.WaitGroup)
+	app.startWorkers(wg)
+	defer close(app.Done)
+
+	tests := []struct {
+		port int
+		unit byte
+		bus  uint16
+	}{
+		{1502, 7, 1},
+		{1502, 15, 2},
+		{1502, 30, 2},
+		{1503, 7, 3},
+		{1503, 200, 3},
+		{1502, 25, 0},
+		{1504, 40, 4},
+		{1504, 7, 1},
+		{1504, 25, 0},
+	}
+
+	for _, tt := range tests {
+		ans, _ := app.processPdu(tt.port, 1, modbus.ReadHoldingRegisters(tt.unit, 0, 1))
+
+		if tt.bus == 0 {
+			if !errors.Is(ans.Err(), modbus.ErrGatewayPathUnavailable) {
+				t.Errorf("unit %d: expected gateway path unavailable, got %v", tt.unit, ans)
+			}
+			continue
+		}
+
+		vals, err := modbus.DecodeValues(ans)
+		if err != nil || vals[0] != tt.bus {
+			t.Errorf("port %d unit %d: expected bus %d, got %v", tt.port, tt.unit, tt.bus, ans)
+		}
+	}
+
+	if ports := app.tcpPorts(); len(ports) != 3 || ports[1] != 1503 || ports[2] != 1504 {
+		t.Errorf("wrong listen ports %v", ports)
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	tests := []struct {
+		units   [][]UnitRange
+		ports   []int
+		invalid bool
+	}{
+		{[][]UnitRange{{{1, 10}}, {{11, 20}}}, []int{0, 0}, false},
+		{[][]UnitRange{{{1, 10}}, {{5, 20}}}, []int{0, 0}, true},
+		{[][]UnitRange{{{1, 10}}, {{5, 20}}}, []int{0, 1503}, false},
+		{[][]UnitRange{{{1, 10}}, {{3, 3}, {10, 12}}}, []int{1503, 1503}, true},
+		{[][]UnitRange{nil, nil}, []int{0, 0}, true},
+		{[][]UnitRange{nil, nil}, []int{1503, 1504}, false},
+		{[][]UnitRange{nil, {{1, 10}}}, []int{0, 0}, false},
+	}
+
+	for i, tt := range tests {
+		app := NewApp(unitBus(1), 0, 1502, zap.NewNop().Sugar())
+		app.buses[0].Units = tt.units[0]
+		app.buses[0].TcpPort = tt.ports[0]
+
+		bus := NewBus("second", unitBus(2))
+		bus.Units = tt.units[1]
+		bus.TcpPort = tt.ports[1]
+		app.AddBus(bus)
+
+		if err := app.checkRoutes(); (err != nil) != tt.invalid {
+			t.Errorf("%d: got error %v", i, err)
+		}
+	}
+}
+
+func TestBusName(t *testing.T) {
+	app := NewApp(modbus.NewTcpUpstream("10.0.0.2:502"), 0, 1502, zap.NewNop().Sugar())
+	app.buses[0].Units = []UnitRange{{1, 10}, {20, 20}}
+
+	bus := NewBus("second", modbus.NewTcpUpstream("10.0.0.2:502"))
+	bus.TcpPort = 1503
+	app.AddBus(bus)
+
+	for _, b := range app.buses {
+		b.Name = busName(b)
+	}
+
+	if names := app.busNames(); names != "tcp 10.0.0.2:502 units=1-10+20, tcp 10.0.0.2:502 tcp_port=1503" {
+		t.Errorf("wrong names %s", names)
+	}
+
+	units, err := parseUnits(formatUnits(app.buses[0].Units))
+	if err != nil || len(units) != 2 || units[0] != (UnitRange{1, 10}) || units[1] != (UnitRange{20, 20}) {
+		t.Errorf("wrong units %v", units)
+	}
+}
+
+func TestParseBus(t *testing.T) {
+	def := BusConfig{Speed: 19200, Turnaround: 100 * time.Millisecond}
+
+	c, err := parseBus("port=tcp://10.0.0.1:4001,speed=9600,units=1-10+20,tcp_port=1503,ascii,echo", def)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if c.Port != "tcp://10.0.0.1:4001" || c.Speed != 9600 || !c.Ascii || !c.Echo || c.TcpPort != 1503 || c.Turnaround != def.Turnaround {
+		t.Errorf("wrong config %+v", c)
+	}
+
+	if len(c.Units) != 2 || c.Units[0] != (UnitRange{1, 10}) || c.Units[1] != (UnitRange{20, 20}) {
+		t.Errorf("wrong units %v", c.Units)
+	}
+
+	for _, s := range []string{"speed=9600", "port=/dev/ttyS1,units=10-1", "port=/dev/ttyS1,parity=E"} {
+		if _, err := parseBus(s, def); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	c, err := parseUpstream("addr=10.0.0.2:502,units=30-39,unit_map=30:1+31:2,timeout=500ms,conns=2")
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if c.Addr != "10.0.0.2:502" || c.Timeout != 500*time.Millisecond || c.Conns != 2 || len(c.Units) != 1 {
+		t.Errorf("wrong config %+v", c)
+	}
+
+	if len(c.UnitMap) != 2 || c.UnitMap[30] != 1 || c.UnitMap[31] != 2 {
+		t.Errorf("wrong unit map %v", c.UnitMap)
+	}
+
+	for _, s := range []string{"units=1", "addr=x:502,conns=0", "addr=x:502,unit_map=1", "addr=x:502,unit_map=1:"} {
+		if _, err := parseUpstream(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+// upstreamServer is modbus tcp server answering read holding registers with the unit id.
+func upstreamServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := modbus.NewTcpFrameReader(conn)
+
+				for {
+					frame, err := reader.ReadFrame()
+					if err != nil {
+						return
+					}
+
+					trId, pdu, _ := modbus.FromTCP(frame)
+					ans := &modbus.ProtocolDataUnit{SlaveId: pdu.SlaveId, FunctionCode: pdu.FunctionCode, Data: []byte{2, 0, pdu.SlaveId}}
+					if _, err := conn.Write(ans.MakeTCP(trId)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestUpstreamBus(t *testing.T) {
+	app := NewApp(unitBus(1), 0, 1502, zap.NewNop().Sugar())
+	app.buses[0].Units = []UnitRange{{From: 1, To: 10}}
+
+	up := modbus.NewTcpUpstream(upstreamServer(t))
+	up.UnitMap[30] = 1
+
+	bus := NewBus("upstream", up)
+	bus.Units = []UnitRange{{From: 0, To: 0}, {From: 30, To: 39}}
+	bus.Workers = 2
+	app.AddBus(bus)
+
+	wg := new(sync.WaitGroup)
+	app.startWorkers(wg)
+	defer close(app.Done)
+
+	for unit, expected := range map[byte]uint16{30: 1, 31: 31, 2: 1, 0: 0} {
+		ans, err := app.processPdu(1502, 7, modbus.ReadHoldingRegisters(unit, 0, 1))
+		if err != nil {
+			t.Fatalf("error %v", err)
+		}
+
+		vals, err := modbus.DecodeValues(ans)
+		if err != nil || ans.SlaveId != unit || vals[0] != expected {
+			t.Errorf("unit %d: expected %d, got %v", unit, expected, ans)
+		}
+	}
+}
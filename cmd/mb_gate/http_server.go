@@ -1,11 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdudkov/mb_gate/modbus"
 )
 
-func (app *App) setRoute() {
-	http.HandleFunc("/", app.handleIndex())
+func (app *App) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.handleIndex())
+	mux.HandleFunc("/stats", app.handleStats())
+	return mux
 }
 
 func (app *App) handleIndex() http.HandlerFunc {
@@ -15,3 +23,30 @@ func (app *App) handleIndex() http.HandlerFunc {
 		}
 	}
 }
+
+func (app *App) handleStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := fmt.Sprintf("retries %d\nretry_failures %d\n",
+			atomic.LoadUint64(&app.stats.Retries), atomic.LoadUint64(&app.stats.RetryFailures))
+
+		for _, b := range app.buses {
+			sp, ok := b.Transport.(*modbus.SerialPort)
+			if !ok {
+				continue
+			}
+
+			stats := sp.Stats()
+			s += fmt.Sprintf("echo_mismatches{bus=%q} %d\nstale_bytes{bus=%q} %d\n", b.Name, stats.EchoMismatches, b.Name, stats.StaleBytes)
+
+			status := sp.Status()
+			s += fmt.Sprintf("port_state{bus=%q} %s\n", b.Name, status.State)
+			if status.LastError != "" {
+				s += fmt.Sprintf("last_error{bus=%q} %s %q\n", b.Name, status.LastErrorTime.Format(time.RFC3339), status.LastError)
+			}
+		}
+
+		if _, err := w.Write([]byte(s)); err != nil {
+			app.Logger.Error("can't write")
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -25,6 +29,8 @@ var (
 )
 
 type Job struct {
+	// Ctx is done when the client is not waiting for the answer anymore
+	Ctx           context.Context
 	TransactionId uint16
 	Pdu           *modbus.ProtocolDataUnit
 	Answer        *modbus.ProtocolDataUnit
@@ -32,55 +38,109 @@ type Job struct {
 }
 
 type App struct {
+	// Done is closed to stop workers
 	Done        chan bool
-	Jobs        chan *Job
-	SerialPort  *modbus.SerialPort
+	buses       []*Bus
 	httpPort    int
 	tcpPort     int
 	translators map[byte]Translator
-	Logger      *zap.SugaredLogger
+	// slave ids without native mask write register support
+	maskEmulation map[byte]bool
+	// retry is the default retry policy, retries are per slave policies
+	retry   RetryPolicy
+	retries map[byte]RetryPolicy
+	stats   Stats
+	Logger  *zap.SugaredLogger
 }
 
-func NewApp(port string, portSpeed int, httpPort int, tcpPort int, logger *zap.SugaredLogger) (app *App) {
+// Stats are gateway counters.
+type Stats struct {
+	Retries uint64
+	// RetryFailures counts transactions failed after retries
+	RetryFailures uint64
+}
+
+// NewApp makes the gateway with transport as the main bus, other buses are added with AddBus.
+func NewApp(transport modbus.Transport, httpPort int, tcpPort int, logger *zap.SugaredLogger) (app *App) {
 	app = &App{
-		Done:        make(chan bool),
-		Jobs:        make(chan *Job, 10),
-		SerialPort:  modbus.NewSerial(port, portSpeed, 8, "N", 1),
-		httpPort:    httpPort,
-		tcpPort:     tcpPort,
-		translators: make(map[byte]Translator),
-		Logger:      logger,
+		Done:          make(chan bool),
+		buses:         []*Bus{NewBus(fmt.Sprint(transport), transport)},
+		httpPort:      httpPort,
+		tcpPort:       tcpPort,
+		translators:   make(map[byte]Translator),
+		maskEmulation: make(map[byte]bool),
+		retries:       make(map[byte]RetryPolicy),
+		Logger:        logger,
 	}
 
-	app.SerialPort.Logger = app.Logger.Named("serial")
 	// addr 5
 	app.translators[5] = NewSimpleChinese()
 	// addr 100
 	app.translators[100] = NewFakeTranslator()
 
-	app.setRoute()
 	return
 }
 
-func (app *App) WorkerLoop(wg *sync.WaitGroup) {
-	wg.Add(1)
+// newSerial makes serial port, tcp://host:port address means network attached serial port in raw mode (rtu over tcp),
+// rfc2217://host:port is telnet com port control server.
+func newSerial(port string, portSpeed int, ascii bool) *modbus.SerialPort {
+	var sp *modbus.SerialPort
+
+	switch {
+	case strings.HasPrefix(port, "tcp://"):
+		sp = modbus.NewNetSerial(strings.TrimPrefix(port, "tcp://"), portSpeed)
+	case strings.HasPrefix(port, "rfc2217://") && ascii:
+		sp = modbus.NewRfc2217Serial(strings.TrimPrefix(port, "rfc2217://"), portSpeed, 7, "E", 1)
+	case strings.HasPrefix(port, "rfc2217://"):
+		sp = modbus.NewRfc2217Serial(strings.TrimPrefix(port, "rfc2217://"), portSpeed, 8, "N", 1)
+	case ascii:
+		// modbus ascii default is 7E1
+		sp = modbus.NewSerial(port, portSpeed, 7, "E", 1)
+	default:
+		sp = modbus.NewSerial(port, portSpeed, 8, "N", 1)
+	}
+
+	if ascii {
+		sp.Mode = modbus.ModeAscii
+	}
+	return sp
+}
+
+// identityObjects returns device identification objects of the gateway.
+func (app *App) identityObjects() map[byte]string {
+	return map[byte]string{
+		modbus.ObjectIdVendorName:         "kdudkov",
+		modbus.ObjectIdProductCode:        "mb_gate",
+		modbus.ObjectIdMajorMinorRevision: fmt.Sprintf("%s:%s", gitBranch, gitRevision),
+		modbus.ObjectIdVendorUrl:          "https://github.com/kdudkov/mb_gate",
+		modbus.ObjectIdProductName:        "Modbus RTU to Modbus TCP gateway",
+		modbus.ObjectIdModelName:          app.busNames(),
+	}
+}
+
+// WorkerLoop executes jobs on the bus one by one, wg.Add must be called before it is started.
+func (app *App) WorkerLoop(bus *Bus, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for {
 		select {
-		case job := <-app.Jobs:
+		case job := <-bus.Jobs:
 			if job.Pdu == nil {
 				app.Logger.Error("nil job pdu")
 				continue
 			}
-			d, _ := job.Pdu.MakeRtu()
-			ans, err := app.SerialPort.Send(d)
+			ctx := job.Ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			l := app.Logger.With(zap.Uint16("tr_id", job.TransactionId), zap.String("bus", bus.Name))
+			ans, err := app.executeRetry(ctx, bus.Transport, job.Pdu, l)
 			if err != nil {
-				app.Logger.With(zap.Uint16("tr_id", job.TransactionId)).Errorf("error %v", err)
-				job.Answer = modbus.NewModbusError(job.Pdu, modbus.ExceptionCodeServerDeviceFailure)
+				l.Errorf("error %v", err)
+				job.Answer = modbus.NewModbusError(job.Pdu, exceptionCode(err))
 			} else {
-				job.Answer, _ = modbus.FromRtu(ans)
-				app.Logger.With(zap.Uint16("tr_id", job.TransactionId)).Debugf("answer %v", job.Answer)
+				job.Answer = ans
+				l.Debugf("answer %v", job.Answer)
 			}
 			job.Ch <- true
 			close(job.Ch)
@@ -90,34 +150,155 @@ func (app *App) WorkerLoop(wg *sync.WaitGroup) {
 	}
 }
 
+// exceptionCode returns exception code for the client when the bus transaction failed.
+// Job deadline is the same as no answer from the slave.
+func exceptionCode(err error) byte {
+	switch {
+	case errors.Is(err, modbus.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond
+	case errors.Is(err, modbus.ErrNotConnected):
+		return modbus.ExceptionCodeGatewayPathUnavailable
+	}
+	return modbus.ExceptionCodeServerDeviceFailure
+}
+
+func (app *App) execute(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	// unit 0 is a normal address for modbus tcp server, and mask write emulation
+	// is not atomic with several workers, so requests to the upstream are sent as is
+	if _, ok := bus.(*modbus.TcpUpstream); ok {
+		return app.transaction(ctx, bus, pdu)
+	}
+
+	if pdu.SlaveId == 0 {
+		return app.broadcast(ctx, bus, pdu)
+	}
+
+	if modbus.IsForceListenOnly(pdu) {
+		return app.sendNoAnswer(ctx, bus, pdu)
+	}
+
+	if pdu.FunctionCode == modbus.FuncCodeMaskWriteRegister && app.maskEmulation[pdu.SlaveId] {
+		return app.emulateMaskWrite(ctx, bus, pdu)
+	}
+	return app.transaction(ctx, bus, pdu)
+}
+
+// broadcast sends write request to all slaves. Nobody answers it, so the client
+// gets the normal write response as soon as the request is sent.
+func (app *App) broadcast(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	if !modbus.IsWriteFunction(pdu.FunctionCode) {
+		return modbus.NewModbusError(pdu, modbus.ExceptionCodeIllegalFunction), nil
+	}
+
+	return app.sendNoAnswer(ctx, bus, pdu)
+}
+
+// sendNoAnswer sends the request nobody answers, e.g. broadcast or force listen only,
+// the client gets the normal response as soon as the request is sent.
+func (app *App) sendNoAnswer(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	d, err := bus.Encode(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := bus.SendContext(ctx, d); err != nil {
+		return nil, err
+	}
+
+	return modbus.WriteResponse(pdu), nil
+}
+
+// transaction sends pdu to the serial bus and returns the answer.
+func (app *App) transaction(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	d, err := bus.Encode(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	ans, err := bus.SendContext(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	return bus.Decode(ans)
+}
+
+// emulateMaskWrite makes mask write register with read (fn 3) and write (fn 6).
+// It is called from the worker only and serial bus has one worker, so nobody can access the bus between read and write.
+func (app *App) emulateMaskWrite(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	addr, andMask, orMask, err := modbus.DecodeMaskWrite(pdu)
+	if err != nil {
+		return modbus.NewModbusError(pdu, modbus.ExceptionCodeIllegalDataValue), nil
+	}
+
+	ans, err := app.transaction(ctx, bus, modbus.ReadHoldingRegisters(pdu.SlaveId, addr, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	if ans.FunctionCode&0x80 != 0 {
+		return modbus.NewModbusError(pdu, ans.Data[0]), nil
+	}
+
+	vals, err := modbus.DecodeValues(ans)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vals) != 1 {
+		return nil, fmt.Errorf("got %d values instead of 1", len(vals))
+	}
+
+	ans, err = app.transaction(ctx, bus, modbus.WriteSingleRegister(pdu.SlaveId, addr, modbus.MaskValue(vals[0], andMask, orMask)))
+	if err != nil {
+		return nil, err
+	}
+
+	if ans.FunctionCode&0x80 != 0 {
+		return modbus.NewModbusError(pdu, ans.Data[0]), nil
+	}
+
+	return modbus.MaskWriteRegister(pdu.SlaveId, addr, andMask, orMask), nil
+}
+
 func (app *App) Run() {
 	app.Logger.Infof("start http server on port %d", app.httpPort)
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", app.httpPort), nil); err != nil {
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", app.httpPort), app.routes()); err != nil {
 			app.Logger.Panic("can't start tcp listener", err)
 		}
 	}()
 
-	app.Logger.Infof("start tcp server on port %d", app.tcpPort)
-	go func() {
-		if err := app.ListenTCP(fmt.Sprintf(":%d", app.tcpPort)); err != nil {
-			app.Logger.Panic("can't start tcp listener", err)
-		}
-	}()
+	for _, port := range app.tcpPorts() {
+		port := port
+		app.Logger.Infof("start tcp server on port %d", port)
+		go func() {
+			if err := app.ListenTCP(fmt.Sprintf(":%d", port)); err != nil {
+				app.Logger.Panic("can't start tcp listener", err)
+			}
+		}()
+	}
 
 	wg := new(sync.WaitGroup)
-	go app.WorkerLoop(wg)
+	app.startWorkers(wg)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	<-c
 
 	app.Logger.Info("exiting...")
-	app.Done <- true
+	close(app.Done)
 	wg.Wait()
+
+	for _, b := range app.buses {
+		if err := b.Transport.Close(); err != nil {
+			app.Logger.Errorf("%s close error %v", b.Name, err)
+		}
+	}
 }
 
-func (app *App) processPdu(transactionId uint16, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+// processPdu processes the request got on the listen port.
+func (app *App) processPdu(port int, transactionId uint16, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
 	tr, ok := app.translators[pdu.SlaveId]
 	if ok {
 		dontSend := tr.Translate(pdu)
@@ -126,15 +307,25 @@ func (app *App) processPdu(transactionId uint16, pdu *modbus.ProtocolDataUnit) (
 		}
 	}
 
-	job := &Job{Ch: make(chan bool), TransactionId: transactionId, Pdu: pdu}
+	bus := app.route(port, pdu.SlaveId)
+	if bus == nil {
+		ans := modbus.NewModbusError(pdu, modbus.ExceptionCodeGatewayPathUnavailable)
+		return ans, fmt.Errorf("no bus for unit %d on port %d", pdu.SlaveId, port)
+	}
+
+	// the worker aborts the bus transaction when ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), app.jobTimeout(bus, pdu.SlaveId))
+	defer cancel()
+
+	job := &Job{Ctx: ctx, Ch: make(chan bool, 1), TransactionId: transactionId, Pdu: pdu}
 
 	select {
-	case app.Jobs <- job:
+	case bus.Jobs <- job:
 		select {
 		case <-job.Ch:
 			return job.Answer, nil
-		case <-time.After(readTimeout):
-			ans := modbus.NewModbusError(pdu, modbus.ExceptionCodeServerDeviceFailure)
+		case <-ctx.Done():
+			ans := modbus.NewModbusError(pdu, exceptionCode(ctx.Err()))
 			return ans, fmt.Errorf("timeout")
 		}
 	default:
@@ -148,8 +339,24 @@ func main() {
 
 	var httpPort = flag.Int("http_port", 8080, "host:port for http")
 	var tcpPort = flag.Int("tcp_port", 1502, "host:port for modbus tcp")
-	var port = flag.String("port", "/dev/ttyS0", "serial port")
+	var port = flag.String("port", "/dev/ttyS0", "serial port, tcp://host:port for rtu over tcp or rfc2217://host:port for telnet com port control server")
 	var portSpeed = flag.Int("speed", 19200, "serial port speed")
+	var ascii = flag.Bool("ascii", false, "use modbus ascii on serial port")
+	var idUnit = flag.Int("id_unit", 0, "unit id to answer device identification (fn 43/14) with gateway info, 0 to disable")
+	var turnaround = flag.Duration("turnaround", 100*time.Millisecond, "delay after broadcast request")
+	var byId = flag.Bool("by_id", false, "use stable /dev/serial/by-id/... path of the port, it is kept after usb adapter replug")
+	var echo = flag.Bool("echo", false, "rs485 adapter echoes sent bytes, read and check the echo")
+	var maskEmulate = flag.String("mask_emulate", "", "comma separated slave ids to emulate mask write register (fn 22) for, on serial buses only")
+	var retryCount = flag.Int("retries", 0, "retry count for failed transactions")
+	var retryBackoff = flag.Duration("retry_backoff", 50*time.Millisecond, "pause before the first retry, doubled for every next one")
+	var retryOn = flag.String("retry_on", "timeout+crc+echo", "plus separated errors to retry on: timeout, crc, echo, answer")
+	var retryWrites = flag.Bool("retry_writes", false, "retry write and other state changing requests too")
+	var slaveRetries = flag.String("slave_retries", "", "comma separated per slave retry policies, e.g. 5:count=3:backoff=100ms:on=timeout+crc:writes")
+	var buses busFlags
+	flag.Var(&buses, "bus", "additional serial bus, e.g. port=/dev/ttyUSB1,speed=9600,units=1-10+20,tcp_port=1503,ascii,echo (repeatable)")
+	var upstreams busFlags
+	flag.Var(&upstreams, "upstream", "modbus tcp server as a bus, e.g. addr=10.0.0.2:502,units=30-39,unit_map=30:1+31:2,timeout=500ms,conns=2 (repeatable)")
+	var units = flag.String("units", "", "plus separated unit ids and ranges served by the main bus, e.g. 1-10+20, all by default")
 	var dev = flag.Bool("devel", false, "development")
 
 	flag.Parse()
@@ -162,6 +369,114 @@ func main() {
 	}
 	defer logger.Sync()
 
-	app := NewApp(*port, *portSpeed, *httpPort, *tcpPort, logger.Sugar())
+	mainUnits, err := parseUnits(*units)
+	if err != nil {
+		logger.Fatal("invalid units value", zap.Error(err))
+	}
+
+	mainBus := BusConfig{Port: *port, Speed: *portSpeed, Ascii: *ascii, Echo: *echo, Turnaround: *turnaround, Units: mainUnits}
+
+	app := NewApp(newBusSerial(mainBus, *byId, logger), *httpPort, *tcpPort, logger.Sugar())
+	app.buses[0].Units = mainUnits
+
+	for _, s := range buses {
+		c, err := parseBus(s, BusConfig{Speed: *portSpeed, Turnaround: *turnaround})
+		if err != nil {
+			logger.Fatal("invalid bus value", zap.Error(err))
+		}
+
+		sp := newBusSerial(c, *byId, logger)
+		bus := NewBus(fmt.Sprint(sp), sp)
+		bus.Units = c.Units
+		bus.TcpPort = c.TcpPort
+		app.AddBus(bus)
+	}
+
+	for _, s := range upstreams {
+		c, err := parseUpstream(s)
+		if err != nil {
+			logger.Fatal("invalid upstream value", zap.Error(err))
+		}
+
+		up := modbus.NewTcpUpstream(c.Addr)
+		up.Timeout = c.Timeout
+		up.UnitMap = c.UnitMap
+		up.MaxIdle = c.Conns
+		up.Logger = logger.Sugar().Named("upstream")
+
+		bus := NewBus(fmt.Sprint(up), up)
+		bus.Units = c.Units
+		bus.TcpPort = c.TcpPort
+		bus.Workers = c.Conns
+		app.AddBus(bus)
+	}
+
+	if err := app.checkRoutes(); err != nil {
+		logger.Fatal("invalid bus routing", zap.Error(err))
+	}
+
+	// routing is in the names, as several buses can have the same transport, e.g. upstream address
+	for _, b := range app.buses {
+		b.Name = busName(b)
+	}
+
+	if *idUnit > 0 && *idUnit < 256 {
+		app.translators[byte(*idUnit)] = NewIdentityTranslator(app.identityObjects())
+	}
+
+	ids, err := parseIds(*maskEmulate)
+	if err != nil {
+		logger.Fatal("invalid mask_emulate value", zap.Error(err))
+	}
+
+	for _, id := range ids {
+		app.maskEmulation[id] = true
+	}
+
+	on, err := parseRetryOn(*retryOn)
+	if err != nil {
+		logger.Fatal("invalid retry_on value", zap.Error(err))
+	}
+
+	app.retry = RetryPolicy{Count: *retryCount, Backoff: *retryBackoff, On: on, Writes: *retryWrites}
+
+	if app.retries, err = parseRetries(*slaveRetries, app.retry); err != nil {
+		logger.Fatal("invalid slave_retries value", zap.Error(err))
+	}
+
 	app.Run()
 }
+
+// newBusSerial makes serial port for the bus.
+func newBusSerial(c BusConfig, byId bool, logger *zap.Logger) *modbus.SerialPort {
+	if byId {
+		c.Port = modbus.SerialById(c.Port)
+		logger.Info("serial port " + c.Port)
+	}
+
+	sp := newSerial(c.Port, c.Speed, c.Ascii)
+	sp.TurnaroundDelay = c.Turnaround
+	sp.EchoCancel = c.Echo
+	sp.Logger = logger.Sugar().Named("serial").With(zap.String("port", c.Port))
+	return sp
+}
+
+// parseIds parses comma separated list of slave ids.
+func parseIds(s string) ([]byte, error) {
+	var res []byte
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, byte(id))
+	}
+
+	return res, nil
+}
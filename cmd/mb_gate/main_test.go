@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/kdudkov/mb_gate/modbus"
+)
+
+// fakeBus answers fn 3 and fn 6 for slave 1, other slaves don't answer.
+type fakeBus struct {
+	registers map[uint16]uint16
+	requests  []*modbus.ProtocolDataUnit
+	mutex     sync.Mutex
+}
+
+func (b *fakeBus) handle(pdu *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.requests = append(b.requests, pdu)
+
+	if pdu.SlaveId != 1 {
+		return nil
+	}
+
+	addr := binary.BigEndian.Uint16(pdu.Data)
+
+	switch pdu.FunctionCode {
+	case modbus.FuncCodeReadHoldingRegisters:
+		num := binary.BigEndian.Uint16(pdu.Data[2:])
+		ans := &modbus.ProtocolDataUnit{SlaveId: 1, FunctionCode: pdu.FunctionCode, Data: make([]byte, 1+2*num)}
+		ans.Data[0] = byte(2 * num)
+		var i uint16
+		for i = 0; i < num; i++ {
+			binary.BigEndian.PutUint16(ans.Data[1+2*i:], b.registers[addr+i])
+		}
+		return ans
+	case modbus.FuncCodeWriteSingleRegister:
+		b.registers[addr] = binary.BigEndian.Uint16(pdu.Data[2:])
+		return modbus.WriteResponse(pdu)
+	default:
+		return modbus.NewModbusError(pdu, modbus.ExceptionCodeIllegalFunction)
+	}
+}
+
+func newTestApp(t *testing.T) (*App, *fakeBus) {
+	bus := &fakeBus{registers: make(map[uint16]uint16)}
+	app := NewApp(modbus.NewPipe(bus.handle), 0, 0, zap.NewNop().Sugar())
+
+	wg := new(sync.WaitGroup)
+	app.startWorkers(wg)
+	t.Cleanup(func() { close(app.Done) })
+
+	return app, bus
+}
+
+func TestWorkerRead(t *testing.T) {
+	app, bus := newTestApp(t)
+	bus.registers[10] = 0x1234
+
+	ans, err := app.processPdu(0, 1, modbus.ReadHoldingRegisters(1, 10, 1))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	vals, err := modbus.DecodeValues(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if vals[0] != 0x1234 {
+		t.Errorf("wrong value %#x", vals[0])
+	}
+
+	ans, _ = app.processPdu(0, 2, modbus.ReadHoldingRegisters(2, 10, 1))
+	if !errors.Is(ans.Err(), modbus.ErrGatewayTargetNoResponse) {
+		t.Errorf("expected no response exception for absent slave, got %v", ans)
+	}
+}
+
+func TestWorkerMaskEmulation(t *testing.T) {
+	app, bus := newTestApp(t)
+	app.maskEmulation[1] = true
+	bus.registers[4] = 0x12
+
+	ans, err := app.processPdu(0, 1, modbus.MaskWriteRegister(1, 4, 0xf2, 0x25))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if ans.Err() != nil || ans.FunctionCode != modbus.FuncCodeMaskWriteRegister {
+		t.Fatalf("wrong answer %v", ans)
+	}
+
+	if bus.registers[4] != 0x17 {
+		t.Errorf("wrong value %#x", bus.registers[4])
+	}
+}
+
+func TestWorkerForceListenOnly(t *testing.T) {
+	app, bus := newTestApp(t)
+
+	pdu := modbus.ForceListenOnly(1)
+	ans, err := app.processPdu(0, 1, pdu)
+	if err != nil || ans.Err() != nil {
+		t.Fatalf("error %v, %v", err, ans)
+	}
+
+	if ans.FunctionCode != modbus.FuncCodeDiagnostic || !modbus.IsForceListenOnly(ans) {
+		t.Errorf("expected echo, got %v", ans)
+	}
+
+	if len(bus.requests) != 1 {
+		t.Errorf("request was not sent")
+	}
+}
+
+func TestWorkerBroadcast(t *testing.T) {
+	app, bus := newTestApp(t)
+
+	ans, err := app.processPdu(0, 1, modbus.WriteSingleRegister(0, 4, 1))
+	if err != nil || ans.Err() != nil {
+		t.Fatalf("error %v, %v", err, ans)
+	}
+
+	if len(bus.requests) != 1 {
+		t.Errorf("broadcast was not sent")
+	}
+
+	ans, _ = app.processPdu(0, 2, modbus.ReadHoldingRegisters(0, 4, 1))
+	if ans.Err() == nil {
+		t.Errorf("broadcast read must be rejected")
+	}
+}
+
+func TestExceptionCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code byte
+	}{
+		{fmt.Errorf("%w: no answer", modbus.ErrTimeout), modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond},
+		{context.DeadlineExceeded, modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond},
+		{fmt.Errorf("%w: no such device", modbus.ErrNotConnected), modbus.ExceptionCodeGatewayPathUnavailable},
+		{modbus.ErrCRCMismatch, modbus.ExceptionCodeServerDeviceFailure},
+	}
+
+	for _, tt := range tests {
+		if code := exceptionCode(tt.err); code != tt.code {
+			t.Errorf("%v: expected %d, got %d", tt.err, tt.code, code)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/kdudkov/mb_gate/modbus"
+)
+
+// retryErrors are names of retryable error groups for -retry_on flag.
+var retryErrors = map[string][]error{
+	"timeout": {modbus.ErrTimeout},
+	"crc":     {modbus.ErrCRCMismatch, modbus.ErrLRCMismatch},
+	"echo":    {modbus.ErrEchoMismatch},
+	"answer":  {modbus.ErrBadSlaveId, modbus.ErrBadFunction, modbus.ErrBadLength},
+}
+
+// RetryPolicy says how to retry failed bus transactions.
+type RetryPolicy struct {
+	Count int
+	// Backoff is the pause before the first retry, it is doubled for every next one
+	Backoff time.Duration
+	// On are errors to retry on
+	On []error
+	// Writes allows to retry writes and other requests that change the slave state, they are not idempotent for some devices
+	Writes bool
+}
+
+func (p RetryPolicy) canRetry(pdu *modbus.ProtocolDataUnit, err error) bool {
+	if modbus.ModifiesState(pdu) && !p.Writes {
+		return false
+	}
+
+	for _, e := range p.On {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	return p.Backoff << attempt
+}
+
+func (app *App) retryPolicy(slaveId byte) RetryPolicy {
+	if p, ok := app.retries[slaveId]; ok {
+		return p
+	}
+	return app.retry
+}
+
+// jobTimeout returns how long the client waits for the answer from the slave on the bus:
+// every attempt of the slave retry policy timed out, backoffs between them and readTimeout to spare for the job queue.
+func (app *App) jobTimeout(bus *Bus, slaveId byte) time.Duration {
+	policy := app.retryPolicy(slaveId)
+
+	d := readTimeout + bus.Timeout
+	for attempt := 0; attempt < policy.Count; attempt++ {
+		d += policy.backoff(attempt) + bus.Timeout
+	}
+	return d
+}
+
+// executeRetry executes the request with retries by the slave policy.
+func (app *App) executeRetry(ctx context.Context, bus modbus.Transport, pdu *modbus.ProtocolDataUnit, l *zap.SugaredLogger) (*modbus.ProtocolDataUnit, error) {
+	policy := app.retryPolicy(pdu.SlaveId)
+
+	for attempt := 0; ; attempt++ {
+		ans, err := app.execute(ctx, bus, pdu)
+		if err == nil {
+			return ans, nil
+		}
+
+		if attempt >= policy.Count || !policy.canRetry(pdu, err) || ctx.Err() != nil {
+			if attempt > 0 {
+				atomic.AddUint64(&app.stats.RetryFailures, 1)
+			}
+			return ans, err
+		}
+
+		atomic.AddUint64(&app.stats.Retries, 1)
+		l.Warnf("error %v, retry %d of %d", err, attempt+1, policy.Count)
+
+		if err := modbus.SleepContext(ctx, policy.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRetryOn parses plus separated list of retryable error names, e.g. timeout+crc.
+func parseRetryOn(s string) ([]error, error) {
+	var res []error
+
+	for _, name := range strings.Split(s, "+") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		errs, ok := retryErrors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown error name %s", name)
+		}
+		res = append(res, errs...)
+	}
+
+	return res, nil
+}
+
+// parseRetries parses comma separated per slave policies like 5:count=3:backoff=100ms:on=timeout+crc:writes,
+// options not given are taken from def.
+func parseRetries(s string, def RetryPolicy) (map[byte]RetryPolicy, error) {
+	res := make(map[byte]RetryPolicy)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		id, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		p := def
+		for _, opt := range parts[1:] {
+			k, v, _ := strings.Cut(opt, "=")
+
+			switch k {
+			case "count":
+				p.Count, err = strconv.Atoi(v)
+			case "backoff":
+				p.Backoff, err = time.ParseDuration(v)
+			case "on":
+				p.On, err = parseRetryOn(v)
+			case "writes":
+				p.Writes = true
+			default:
+				err = fmt.Errorf("unknown retry option %s", k)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("slave %d: %w", id, err)
+			}
+		}
+
+		res[byte(id)] = p
+	}
+
+	return res, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kdudkov/mb_gate/modbus"
+)
+
+// flakyBus does not answer first fails requests.
+type flakyBus struct {
+	*fakeBus
+	fails int
+}
+
+func (b *flakyBus) handle(pdu *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+	if b.fails > 0 {
+		b.fails--
+		return nil
+	}
+	return b.fakeBus.handle(pdu)
+}
+
+func newFlakyApp(t *testing.T, fails int, policy RetryPolicy) (*App, *flakyBus) {
+	app, bus := newTestApp(t)
+	flaky := &flakyBus{fakeBus: bus, fails: fails}
+	app.buses[0].Transport = modbus.NewPipe(flaky.handle)
+	app.retry = policy
+	return app, flaky
+}
+
+func TestRetry(t *testing.T) {
+	app, bus := newFlakyApp(t, 2, RetryPolicy{Count: 2, Backoff: time.Millisecond, On: []error{modbus.ErrTimeout}})
+	bus.registers[1] = 5
+
+	ans, err := app.processPdu(0, 1, modbus.ReadHoldingRegisters(1, 1, 1))
+	if err != nil || ans.Err() != nil {
+		t.Fatalf("error %v, %v", err, ans)
+	}
+
+	if n := atomic.LoadUint64(&app.stats.Retries); n != 2 {
+		t.Errorf("got %d retries, expected 2", n)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	app, _ := newFlakyApp(t, 3, RetryPolicy{Count: 2, Backoff: time.Millisecond, On: []error{modbus.ErrTimeout}})
+
+	ans, _ := app.processPdu(0, 1, modbus.ReadHoldingRegisters(1, 1, 1))
+	if !errors.Is(ans.Err(), modbus.ErrGatewayTargetNoResponse) {
+		t.Errorf("expected no response exception, got %v", ans)
+	}
+
+	if n := atomic.LoadUint64(&app.stats.RetryFailures); n != 1 {
+		t.Errorf("got %d retry failures, expected 1", n)
+	}
+}
+
+func TestNoWriteRetry(t *testing.T) {
+	policy := RetryPolicy{Count: 2, Backoff: time.Millisecond, On: []error{modbus.ErrTimeout}}
+	app, bus := newFlakyApp(t, 1, policy)
+
+	ans, _ := app.processPdu(0, 1, modbus.WriteSingleRegister(1, 1, 7))
+	if ans.Err() == nil || len(bus.requests) != 0 {
+		t.Errorf("write must not be retried")
+	}
+
+	policy.Writes = true
+	app.retries[1] = policy
+	bus.fails = 1
+
+	ans, _ = app.processPdu(0, 1, modbus.WriteSingleRegister(1, 1, 7))
+	if ans.Err() != nil || bus.registers[1] != 7 {
+		t.Errorf("write must be retried, got %v", ans)
+	}
+}
+
+func TestNoStateChangeRetry(t *testing.T) {
+	policy := RetryPolicy{Count: 2, Backoff: time.Millisecond, On: []error{modbus.ErrTimeout}}
+
+	for _, pdu := range []*modbus.ProtocolDataUnit{
+		modbus.ReadWriteMultipleRegisters(1, 0, 1, 1, []uint16{7}),
+		modbus.RestartCommunications(1, false),
+	} {
+		app, bus := newFlakyApp(t, 1, policy)
+
+		ans, _ := app.processPdu(0, 1, pdu)
+		if ans.Err() == nil || len(bus.requests) != 0 {
+			t.Errorf("fn %d must not be retried", pdu.FunctionCode)
+		}
+
+		if n := atomic.LoadUint64(&app.stats.Retries); n != 0 {
+			t.Errorf("fn %d: got %d retries", pdu.FunctionCode, n)
+		}
+	}
+}
+
+// slowTransport waits for the timeout before it returns ErrTimeout, as the serial port does.
+type slowTransport struct {
+	modbus.Transport
+	timeout time.Duration
+}
+
+func (t *slowTransport) SendContext(ctx context.Context, adu []byte) ([]byte, error) {
+	res, err := t.Transport.SendContext(ctx, adu)
+	if errors.Is(err, modbus.ErrTimeout) {
+		if err := modbus.SleepContext(ctx, t.timeout); err != nil {
+			return nil, err
+		}
+	}
+	return res, err
+}
+
+func TestRetryAfterSlowTimeout(t *testing.T) {
+	app, bus := newFlakyApp(t, 2, RetryPolicy{Count: 2, Backoff: time.Millisecond, On: []error{modbus.ErrTimeout}})
+	bus.registers[1] = 5
+
+	// two timeouts take longer than readTimeout
+	timeout := 600 * time.Millisecond
+	app.buses[0].Transport = &slowTransport{Transport: app.buses[0].Transport, timeout: timeout}
+	app.buses[0].Timeout = timeout
+
+	ans, err := app.processPdu(0, 1, modbus.ReadHoldingRegisters(1, 1, 1))
+	if err != nil || ans.Err() != nil {
+		t.Fatalf("error %v, %v", err, ans)
+	}
+
+	if n := atomic.LoadUint64(&app.stats.Retries); n != 2 {
+		t.Errorf("got %d retries, expected 2", n)
+	}
+}
+
+func TestParseRetries(t *testing.T) {
+	def := RetryPolicy{Count: 1, Backoff: time.Millisecond}
+
+	res, err := parseRetries("5:count=3:backoff=100ms:on=timeout+echo:writes, 7", def)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	p := res[5]
+	if p.Count != 3 || p.Backoff != 100*time.Millisecond || len(p.On) != 2 || !p.Writes {
+		t.Errorf("wrong policy %+v", p)
+	}
+
+	if res[7].Count != 1 || res[7].Backoff != time.Millisecond {
+		t.Errorf("wrong default policy %+v", res[7])
+	}
+
+	if _, err := parseRetries("5:on=bad", def); err == nil {
+		t.Errorf("expected error for bad error name")
+	}
+}
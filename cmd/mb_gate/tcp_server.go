@@ -1,10 +1,12 @@
 package main
 
 import (
-	"go.uber.org/zap"
+	"errors"
 	"net"
 	"time"
 
+	"go.uber.org/zap"
+
 	"github.com/kdudkov/mb_gate/modbus"
 )
 
@@ -26,6 +28,11 @@ func (app *App) ListenTCP(addressPort string) (err error) {
 		return err
 	}
 
+	port := listen.Addr().(*net.TCPAddr).Port
+	processor := func(transactionId uint16, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+		return app.processPdu(port, transactionId, pdu)
+	}
+
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
@@ -34,28 +41,37 @@ func (app *App) ListenTCP(addressPort string) (err error) {
 		}
 
 		h := TcpHandler{conn: conn, logger: app.Logger}
-		go h.handle(app.processPdu)
+		go h.handle(processor)
 	}
 }
 
 func (h *TcpHandler) handle(processor func(transactionId uint16, pdu *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error)) {
 	defer h.conn.Close()
 
+	reader := modbus.NewTcpFrameReader(h.conn)
+
 	for {
-		packet := make([]byte, 255)
-		bytesRead, err := h.conn.Read(packet)
+		packet, err := reader.ReadFrame()
 		if err != nil {
 			if h.closeTimer != nil {
 				h.closeTimer.Stop()
 			}
+			if errors.Is(err, modbus.ErrBadProtocolID) || errors.Is(err, modbus.ErrBadLength) {
+				h.logger.Errorf("bad packet error %v", err)
+			}
 			return
 		}
 		h.setActivity()
 
-		transactionId, pdu, err := modbus.FromTCP(packet[:bytesRead])
+		transactionId, pdu, err := modbus.FromTCP(packet)
 		l := h.logger.With("tr_id", transactionId)
 
 		if err != nil {
+			if errors.Is(err, modbus.ErrBadPayload) && pdu != nil {
+				l.Warnf("bad pdu: %v", err)
+				h.send(l, transactionId, modbus.NewModbusError(pdu, modbus.ExceptionCodeIllegalDataValue))
+				continue
+			}
 			h.logger.Errorf("bad packet error %v", err)
 			return
 		}
@@ -71,11 +87,15 @@ func (h *TcpHandler) handle(processor func(transactionId uint16, pdu *modbus.Pro
 		}
 		l.Debugf("answer: %v", ans)
 
-		if _, err := h.conn.Write(ans.MakeTCP(transactionId)); err != nil {
-			l.Error("error sending answer")
-		}
-		h.setActivity()
+		h.send(l, transactionId, ans)
+	}
+}
+
+func (h *TcpHandler) send(l *zap.SugaredLogger, transactionId uint16, ans *modbus.ProtocolDataUnit) {
+	if _, err := h.conn.Write(ans.MakeTCP(transactionId)); err != nil {
+		l.Error("error sending answer")
 	}
+	h.setActivity()
 }
 
 func (h *TcpHandler) setActivity() {
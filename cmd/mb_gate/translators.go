@@ -71,6 +71,7 @@ func (s *SimpleChineese) Translate(pdu *modbus.ProtocolDataUnit) (dontSend bool)
 type FakeTranslator struct {
 	registers []uint16
 	coils     []bool
+	files     map[uint16]map[uint16]uint16
 	mutex     sync.Mutex
 }
 
@@ -78,6 +79,7 @@ func NewFakeTranslator() *FakeTranslator {
 	f := &FakeTranslator{}
 	f.registers = make([]uint16, 65535)
 	f.coils = make([]bool, 65535)
+	f.files = make(map[uint16]map[uint16]uint16)
 	f.mutex = sync.Mutex{}
 	return f
 }
@@ -115,6 +117,88 @@ func (t *FakeTranslator) Translate(pdu *modbus.ProtocolDataUnit) bool {
 		}
 		return true
 
+	case modbus.FuncCodeMaskWriteRegister:
+		addr, andMask, orMask, err := modbus.DecodeMaskWrite(pdu)
+		if err != nil {
+			return true
+		}
+		// response is the echo of the request
+		t.registers[addr] = modbus.MaskValue(t.registers[addr], andMask, orMask)
+		return true
+
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		if len(pdu.Data) < 9 {
+			setException(pdu, modbus.ExceptionCodeIllegalDataValue)
+			return true
+		}
+
+		readAddr := binary.BigEndian.Uint16(pdu.Data)
+		readNum := int(binary.BigEndian.Uint16(pdu.Data[2:]))
+		writeAddr := binary.BigEndian.Uint16(pdu.Data[4:])
+		writeNum := int(binary.BigEndian.Uint16(pdu.Data[6:]))
+
+		if readNum < 1 || readNum > 125 || writeNum < 1 || writeNum > 121 ||
+			int(pdu.Data[8]) != writeNum*2 || len(pdu.Data) != 9+writeNum*2 {
+			setException(pdu, modbus.ExceptionCodeIllegalDataValue)
+			return true
+		}
+
+		// write is performed before read
+		for i := 0; i < writeNum; i++ {
+			t.registers[writeAddr+uint16(i)] = binary.BigEndian.Uint16(pdu.Data[9+2*i:])
+		}
+
+		pdu.Data = make([]byte, readNum*2+1)
+		pdu.Data[0] = byte(readNum * 2)
+
+		for i := 0; i < readNum; i++ {
+			binary.BigEndian.PutUint16(pdu.Data[2*i+1:], t.registers[readAddr+uint16(i)])
+		}
+		return true
+
+	case modbus.FuncCodeReadFileRecord:
+		records, err := modbus.DecodeFileRecords(pdu)
+		if err != nil {
+			return true
+		}
+
+		if modbus.ReadFileRecordResponseSize(records) > modbus.PduMaxSize {
+			setException(pdu, modbus.ExceptionCodeIllegalDataValue)
+			return true
+		}
+
+		values := make([][]uint16, len(records))
+		for n, r := range records {
+			values[n] = make([]uint16, r.Length)
+			for i := range values[n] {
+				values[n][i] = t.files[r.File][r.Record+uint16(i)]
+			}
+		}
+		ans, err := modbus.MakeReadFileRecordResponse(pdu.SlaveId, values)
+		if err != nil {
+			setException(pdu, modbus.ExceptionCodeIllegalDataValue)
+			return true
+		}
+		pdu.Data = ans.Data
+		return true
+
+	case modbus.FuncCodeWriteFileRecord:
+		records, err := modbus.DecodeFileRecords(pdu)
+		if err != nil {
+			return true
+		}
+
+		// response is the echo of the request
+		for _, r := range records {
+			if t.files[r.File] == nil {
+				t.files[r.File] = make(map[uint16]uint16)
+			}
+			for i, v := range r.Values {
+				t.files[r.File][r.Record+uint16(i)] = v
+			}
+		}
+		return true
+
 	case modbus.FuncCodeWriteSingleCoil:
 		addr := binary.BigEndian.Uint16(pdu.Data)
 		val := binary.BigEndian.Uint16(pdu.Data[2:])
@@ -159,3 +243,34 @@ func (t *FakeTranslator) Translate(pdu *modbus.ProtocolDataUnit) bool {
 
 	return true
 }
+
+// setException replaces the request with the exception answer.
+func setException(pdu *modbus.ProtocolDataUnit, code byte) {
+	ans := modbus.NewModbusError(pdu, code)
+	pdu.FunctionCode = ans.FunctionCode
+	pdu.Data = ans.Data
+}
+
+// IdentityTranslator answers read device identification requests with gateway info.
+// All other functions are rejected, nothing is sent to the bus.
+type IdentityTranslator struct {
+	objects map[byte]string
+}
+
+func NewIdentityTranslator(objects map[byte]string) *IdentityTranslator {
+	return &IdentityTranslator{objects: objects}
+}
+
+func (t *IdentityTranslator) Translate(pdu *modbus.ProtocolDataUnit) bool {
+	var ans *modbus.ProtocolDataUnit
+
+	if pdu.FunctionCode == modbus.FuncCodeEncapsulatedInterfaceTransport && len(pdu.Data) > 0 && pdu.Data[0] == modbus.MEITypeReadDeviceId {
+		ans = modbus.MakeDeviceIdentificationResponse(pdu, modbus.ConformityLevelRegular, t.objects)
+	} else {
+		ans = modbus.NewModbusError(pdu, modbus.ExceptionCodeIllegalFunction)
+	}
+
+	pdu.FunctionCode = ans.FunctionCode
+	pdu.Data = ans.Data
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -190,3 +191,142 @@ func TestWriteFakeWriteCoils(t *testing.T) {
 		}
 	}
 }
+
+func TestFakeReadWrite(t *testing.T) {
+	tr := NewFakeTranslator()
+	tr.registers[1] = 5
+
+	pdu := modbus.ReadWriteMultipleRegisters(100, 0, 4, 2, []uint16{10, 20})
+	tr.Translate(pdu)
+
+	res, err := modbus.DecodeValues(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	for i, v := range []uint16{0, 5, 10, 20} {
+		if res[i] != v {
+			t.Errorf("wrong value %d at %d, expected %d", res[i], i, v)
+		}
+	}
+}
+
+func TestFakeReadWriteBadLength(t *testing.T) {
+	tr := NewFakeTranslator()
+
+	for _, data := range [][]byte{
+		// write quantity 2 without values
+		{0, 0, 0, 1, 0, 0, 0, 2, 4},
+		// byte count does not match write quantity
+		{0, 0, 0, 1, 0, 0, 0, 2, 2, 0, 1},
+		// read quantity overflows the answer length
+		{0, 0, 0x80, 0, 0, 0, 0, 1, 2, 0, 1},
+		{0, 0, 0, 1},
+	} {
+		pdu := &modbus.ProtocolDataUnit{SlaveId: 100, FunctionCode: modbus.FuncCodeReadWriteMultipleRegisters, Data: data}
+		tr.Translate(pdu)
+
+		if !errors.Is(pdu.Err(), modbus.ErrIllegalDataValue) {
+			t.Errorf("%x: expected illegal data value, got %v", data, pdu)
+		}
+	}
+}
+
+func TestFakeMaskWrite(t *testing.T) {
+	tr := NewFakeTranslator()
+	tr.registers[4] = 0x12
+
+	pdu := modbus.MaskWriteRegister(100, 4, 0xf2, 0x25)
+	tr.Translate(pdu)
+
+	if tr.registers[4] != 0x17 {
+		t.Errorf("wrong value %#x", tr.registers[4])
+	}
+
+	addr, andMask, orMask, err := modbus.DecodeMaskWrite(pdu)
+	if err != nil || addr != 4 || andMask != 0xf2 || orMask != 0x25 {
+		t.Errorf("wrong echo %v", pdu)
+	}
+}
+
+func TestFakeFileRecords(t *testing.T) {
+	tr := NewFakeTranslator()
+
+	pdu := modbus.WriteFileRecord(100, []modbus.FileRecord{
+		{File: 4, Record: 7, Values: []uint16{0x6af, 0x4be, 0x100d}},
+		{File: 3, Record: 9, Values: []uint16{1}},
+	})
+	tr.Translate(pdu)
+
+	if _, err := modbus.DecodeFileRecords(pdu); err != nil {
+		t.Fatalf("bad echo: %v", err)
+	}
+
+	pdu = modbus.ReadFileRecord(100, []modbus.FileRecord{
+		{File: 4, Record: 8, Length: 2},
+		{File: 3, Record: 9, Length: 2},
+	})
+	tr.Translate(pdu)
+
+	res, err := modbus.DecodeReadFileRecord(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	expected := [][]uint16{{0x4be, 0x100d}, {1, 0}}
+	if len(res) != len(expected) {
+		t.Fatalf("got %d records", len(res))
+	}
+
+	for n := range expected {
+		for i, v := range expected[n] {
+			if res[n][i] != v {
+				t.Errorf("wrong value %#x in record %d:%d", res[n][i], n, i)
+			}
+		}
+	}
+}
+
+func TestFakeFileRecordTooLong(t *testing.T) {
+	tr := NewFakeTranslator()
+
+	// 124 registers make 252 bytes response
+	pdu := modbus.ReadFileRecord(100, []modbus.FileRecord{{File: 4, Record: 0, Length: 124}})
+	tr.Translate(pdu)
+
+	if res, err := modbus.DecodeReadFileRecord(pdu); err != nil || len(res[0]) != 124 {
+		t.Errorf("error %v", err)
+	}
+
+	pdu = modbus.ReadFileRecord(100, []modbus.FileRecord{{File: 4, Record: 0, Length: 100}, {File: 3, Record: 0, Length: 25}})
+	tr.Translate(pdu)
+
+	if !errors.Is(pdu.Err(), modbus.ErrIllegalDataValue) {
+		t.Errorf("expected illegal data value, got %v", pdu)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tr := NewIdentityTranslator(map[byte]string{modbus.ObjectIdVendorName: "v", modbus.ObjectIdProductCode: "p"})
+
+	pdu := modbus.ReadDeviceIdentification(200, modbus.ReadDeviceIdBasic, 0)
+	if !tr.Translate(pdu) {
+		t.Fatal("should not send")
+	}
+
+	res, err := modbus.DecodeDeviceIdentification(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if res.Objects[modbus.ObjectIdVendorName] != "v" || res.Objects[modbus.ObjectIdProductCode] != "p" {
+		t.Errorf("wrong objects %v", res.Objects)
+	}
+
+	pdu = modbus.ReadHoldingRegisters(200, 0, 1)
+	tr.Translate(pdu)
+
+	if pdu.ErrString() == "" || pdu.Data[0] != modbus.ExceptionCodeIllegalFunction {
+		t.Errorf("expected exception, got %v", pdu)
+	}
+}
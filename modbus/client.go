@@ -1,50 +1,91 @@
 package modbus
 
 import (
-	"encoding/binary"
 	"fmt"
 	"net"
 )
 
 type MbClient struct {
-	addr string
-	conn net.Conn
-	trId uint16
+	addr   string
+	conn   net.Conn
+	reader *TcpFrameReader
+	trId   uint16
+	// bus is used instead of modbus tcp connection for rtu over tcp
+	bus *SerialPort
 }
 
 func NewClient(addr string) *MbClient {
 	return &MbClient{addr: addr}
 }
 
+// NewRtuOverTcpClient makes client sending rtu frames over tcp, e.g. to ethernet to rs485 converter.
+// Baud rate of the bus is used for timings.
+func NewRtuOverTcpClient(addr string, baudrate int) *MbClient {
+	return &MbClient{addr: addr, bus: NewNetSerial(addr, baudrate)}
+}
+
 func (s *MbClient) Connect() error {
+	if s.bus != nil {
+		return s.bus.Connect()
+	}
+
 	if s.conn != nil {
 		return nil
 	}
 
 	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		return err
+	}
 	s.conn = conn
-	return err
+	s.reader = NewTcpFrameReader(conn)
+	return nil
 }
 
 func (s *MbClient) Send(pdu *ProtocolDataUnit) (*ProtocolDataUnit, error) {
-	data := pdu.MakeTCP(s.trId)
+	if s.bus != nil {
+		return s.sendRtu(pdu)
+	}
+
+	trId := s.trId
+	data := pdu.MakeTCP(trId)
 	s.trId++
 
 	if _, err := s.conn.Write(data); err != nil {
 		return nil, err
 	}
 
-	res := make([]byte, 255)
-
-	n, err := s.conn.Read(res)
+	res, err := s.reader.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
 
-	_, ans, err := FromTCP(res[:n])
+	ansId, ans, err := FromTCPResponse(res)
+	if err == nil && ansId != trId {
+		return nil, fmt.Errorf("transaction id mismatch: sent %d, got %d", trId, ansId)
+	}
 	return ans, err
 }
 
+// sendRtu sends the request as rtu frame, the connection is reopened after errors.
+func (s *MbClient) sendRtu(pdu *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	adu, err := pdu.MakeRtu()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.bus.Send(adu)
+	if err != nil {
+		return nil, err
+	}
+
+	// nobody answers broadcast
+	if res == nil {
+		return WriteResponse(pdu), nil
+	}
+	return FromRtu(res)
+}
+
 func (s *MbClient) ReadCoils(slaveId byte, addr, count uint16) ([]bool, error) {
 	pdu := ReadCoils(slaveId, addr, count)
 
@@ -53,8 +94,8 @@ func (s *MbClient) ReadCoils(slaveId byte, addr, count uint16) ([]bool, error) {
 		return nil, err
 	}
 
-	if ans.ErrString() != "" {
-		return nil, fmt.Errorf("error %s", ans.ErrString())
+	if err := ans.Err(); err != nil {
+		return nil, err
 	}
 	return DecodeCoils(ans)
 }
@@ -67,12 +108,133 @@ func (s *MbClient) ReadHoldingRegisters(slaveId byte, addr, count uint16) ([]uin
 		return nil, err
 	}
 
-	if ans.ErrString() != "" {
-		return nil, fmt.Errorf("error %s", ans.ErrString())
+	if err := ans.Err(); err != nil {
+		return nil, err
+	}
+	return DecodeValues(ans)
+}
+
+// ReadWriteHoldingRegisters writes values to writeAddr and then reads count registers from readAddr.
+func (s *MbClient) ReadWriteHoldingRegisters(slaveId byte, readAddr, count, writeAddr uint16, values []uint16) ([]uint16, error) {
+	pdu := ReadWriteMultipleRegisters(slaveId, readAddr, count, writeAddr, values)
+
+	ans, err := s.Send(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ans.Err(); err != nil {
+		return nil, err
 	}
 	return DecodeValues(ans)
 }
 
+func (s *MbClient) ReadFIFOQueue(slaveId byte, addr uint16) ([]uint16, error) {
+	pdu := ReadFIFOQueue(slaveId, addr)
+
+	ans, err := s.Send(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ans.Err(); err != nil {
+		return nil, err
+	}
+	return DecodeFIFOQueue(ans)
+}
+
+// ReadFileRecords reads file records and returns values for every record.
+func (s *MbClient) ReadFileRecords(slaveId byte, records []FileRecord) ([][]uint16, error) {
+	pdu := ReadFileRecord(slaveId, records)
+
+	ans, err := s.Send(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ans.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := DecodeReadFileRecord(ans)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) != len(records) {
+		return nil, fmt.Errorf("got %d records instead of %d", len(res), len(records))
+	}
+	return res, nil
+}
+
+// ReadDeviceIdentification reads all objects of the category (basic, regular or extended),
+// following "more follows" continuations.
+func (s *MbClient) ReadDeviceIdentification(slaveId byte, code byte) (map[byte]string, error) {
+	res := make(map[byte]string)
+	var objectId byte
+
+	for {
+		ans, err := s.Send(ReadDeviceIdentification(slaveId, code, objectId))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ans.Err(); err != nil {
+			return nil, err
+		}
+
+		id, err := DecodeDeviceIdentification(ans)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range id.Objects {
+			res[k] = v
+		}
+
+		if !id.MoreFollows || code == ReadDeviceIdSpecific {
+			return res, nil
+		}
+
+		if id.NextObjectId <= objectId || len(id.Objects) == 0 {
+			return nil, fmt.Errorf("bad next object id %#x", id.NextObjectId)
+		}
+		objectId = id.NextObjectId
+	}
+}
+
+// ReadInto reads registers (fn 3 or 4) needed for the struct v and decodes them with Unmarshal.
+func (s *MbClient) ReadInto(slaveId byte, fn byte, addr uint16, v any) error {
+	if fn != FuncCodeReadHoldingRegisters && fn != FuncCodeReadInputRegisters {
+		return fmt.Errorf("wrong function %x for reading registers", fn)
+	}
+
+	span, err := RegisterSpan(v)
+	if err != nil {
+		return err
+	}
+
+	if span == 0 || span > 125 {
+		return fmt.Errorf("can't read %d registers at once", span)
+	}
+
+	ans, err := s.Send(readManyPDU(slaveId, fn, addr, uint16(span)))
+	if err != nil {
+		return err
+	}
+
+	if err := ans.Err(); err != nil {
+		return err
+	}
+
+	regs, err := DecodeValues(ans)
+	if err != nil {
+		return err
+	}
+
+	return Unmarshal(regs, v)
+}
+
 func (s *MbClient) ReadString(slaveId byte, addr, count uint16) (string, error) {
 	pdu := ReadHoldingRegisters(slaveId, addr, count)
 	resp, err := s.Send(pdu)
@@ -85,8 +247,8 @@ func (s *MbClient) ReadString(slaveId byte, addr, count uint16) (string, error)
 		return "", fmt.Errorf("empty resp")
 	}
 
-	if resp.ErrString() != "" {
-		return "", fmt.Errorf("error: %s", resp.ErrString())
+	if err := resp.Err(); err != nil {
+		return "", err
 	}
 
 	return getString(resp)
@@ -104,8 +266,8 @@ func (s *MbClient) WriteCoil(slaveId byte, addr uint16, value bool) error {
 		return fmt.Errorf("empty resp")
 	}
 
-	if resp.ErrString() != "" {
-		return fmt.Errorf("error: %s", resp.ErrString())
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	return nil
@@ -123,8 +285,8 @@ func (s *MbClient) WriteHoldingRegister(slaveId byte, addr uint16, value uint16)
 		return fmt.Errorf("empty resp")
 	}
 
-	if resp.ErrString() != "" {
-		return fmt.Errorf("error: %s", resp.ErrString())
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	return nil
@@ -142,38 +304,197 @@ func (s *MbClient) WriteHoldingRegisters(slaveId byte, addr uint16, values []uin
 		return fmt.Errorf("empty resp")
 	}
 
-	if resp.ErrString() != "" {
-		return fmt.Errorf("error: %s", resp.ErrString())
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func getString(pdu *ProtocolDataUnit) (string, error) {
-	var i byte
-	var s string
+func (s *MbClient) MaskWriteRegister(slaveId byte, addr uint16, andMask uint16, orMask uint16) error {
+	pdu := MaskWriteRegister(slaveId, addr, andMask, orMask)
+	resp, err := s.Send(pdu)
+
+	if err != nil {
+		return err
+	}
+
+	if resp == nil {
+		return fmt.Errorf("empty resp")
+	}
 
-	if len(pdu.Data) == 0 {
-		return "", fmt.Errorf("no data")
+	if err := resp.Err(); err != nil {
+		return err
 	}
 
-	size := pdu.Data[0]
+	a, and, or, err := DecodeMaskWrite(resp)
+	if err != nil {
+		return err
+	}
 
-	if len(pdu.Data) < 2*int(size)+1 {
-		return "", fmt.Errorf("no data")
+	if a != addr || and != andMask || or != orMask {
+		return fmt.Errorf("wrong echo: addr %#x, and %#.4x, or %#.4x", a, and, or)
 	}
 
-	for i = 0; i < size; i++ {
-		val := binary.BigEndian.Uint16(pdu.Data[1+i*2:])
-		if val == 0 {
-			return s, nil
-		}
-		s += fmt.Sprint(val)
+	return nil
+}
+
+func (s *MbClient) WriteFileRecords(slaveId byte, records []FileRecord) error {
+	pdu := WriteFileRecord(slaveId, records)
+	resp, err := s.Send(pdu)
+
+	if err != nil {
+		return err
+	}
+
+	if resp == nil {
+		return fmt.Errorf("empty resp")
+	}
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *MbClient) ReturnQueryData(slaveId byte, data []byte) error {
+	pdu := ReturnQueryData(slaveId, data)
+	resp, err := s.Send(pdu)
+
+	if err != nil {
+		return err
+	}
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	return checkDiagnosticEcho(pdu, resp)
+}
+
+func (s *MbClient) RestartCommunications(slaveId byte, clearLog bool) error {
+	pdu := RestartCommunications(slaveId, clearLog)
+	resp, err := s.Send(pdu)
+
+	if err != nil {
+		return err
+	}
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	return checkDiagnosticEcho(pdu, resp)
+}
+
+func (s *MbClient) ClearCounters(slaveId byte) error {
+	pdu := DiagnosticCounter(slaveId, DiagClearCounters)
+	resp, err := s.Send(pdu)
+
+	if err != nil {
+		return err
 	}
-	return s, nil
+
+	if err := resp.Err(); err != nil {
+		return err
+	}
+
+	return checkDiagnosticEcho(pdu, resp)
+}
+
+// DiagnosticCounter returns counter (or diagnostic register) for the sub-function.
+func (s *MbClient) DiagnosticCounter(slaveId byte, subFunction uint16) (uint16, error) {
+	resp, err := s.Send(DiagnosticCounter(slaveId, subFunction))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return 0, err
+	}
+
+	return DecodeDiagnosticCounter(resp, subFunction)
+}
+
+// ForceListenOnly puts device to listen only mode. Device doesn't answer this request,
+// rtu client and mb_gate don't wait for the answer, so only transport errors are returned.
+func (s *MbClient) ForceListenOnly(slaveId byte) error {
+	_, err := s.Send(ForceListenOnly(slaveId))
+	return err
+}
+
+func (s *MbClient) ReadExceptionStatus(slaveId byte) (byte, error) {
+	resp, err := s.Send(ReadExceptionStatus(slaveId))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return 0, err
+	}
+
+	return DecodeExceptionStatus(resp)
+}
+
+func (s *MbClient) GetComEventCounter(slaveId byte) (status uint16, count uint16, err error) {
+	resp, err := s.Send(GetComEventCounter(slaveId))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return DecodeComEventCounter(resp)
+}
+
+func (s *MbClient) GetComEventLog(slaveId byte) (*ComEventLog, error) {
+	resp, err := s.Send(GetComEventLog(slaveId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	return DecodeComEventLog(resp)
+}
+
+func (s *MbClient) ReportSlaveId(slaveId byte) (*SlaveIdReport, error) {
+	resp, err := s.Send(ReportSlaveId(slaveId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	return DecodeSlaveIdReport(resp)
+}
+
+func getString(pdu *ProtocolDataUnit) (string, error) {
+	vals, err := DecodeValues(pdu)
+	if err != nil {
+		return "", err
+	}
+
+	// one char per register, as wiren devices do
+	return DecodeString(vals, StringOptions{CharPerRegister: true, ZeroTerminated: true}), nil
 }
 
 func (s *MbClient) Close() error {
+	if s.bus != nil {
+		return s.bus.Close()
+	}
 	if s.conn != nil {
 		return s.conn.Close()
 	}
@@ -0,0 +1,315 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Order is the order of bytes in multi-register value, for value 0xAABBCCDD
+// ABCD means registers 0xAABB, 0xCCDD.
+type Order int
+
+const (
+	// OrderABCD is big endian, high word first
+	OrderABCD Order = iota
+	// OrderCDAB is big endian words, low word first
+	OrderCDAB
+	// OrderBADC is little endian words, high word first
+	OrderBADC
+	// OrderDCBA is little endian
+	OrderDCBA
+)
+
+// StringOptions describes how the string is packed into registers.
+type StringOptions struct {
+	// LowByteFirst means first char is in the low byte of the register
+	LowByteFirst bool
+	// CharPerRegister means only the low byte of every register is used
+	CharPerRegister bool
+	// ZeroTerminated means the string ends at the first zero byte,
+	// otherwise trailing zeros and spaces are trimmed
+	ZeroTerminated bool
+}
+
+func ParseOrder(s string) (Order, error) {
+	switch s {
+	case "", "abcd", "ABCD":
+		return OrderABCD, nil
+	case "cdab", "CDAB":
+		return OrderCDAB, nil
+	case "badc", "BADC":
+		return OrderBADC, nil
+	case "dcba", "DCBA":
+		return OrderDCBA, nil
+	default:
+		return OrderABCD, fmt.Errorf("unknown order %s", s)
+	}
+}
+
+func (o Order) String() string {
+	switch o {
+	case OrderCDAB:
+		return "cdab"
+	case OrderBADC:
+		return "badc"
+	case OrderDCBA:
+		return "dcba"
+	default:
+		return "abcd"
+	}
+}
+
+// RegistersToBytes returns value bytes in big endian order.
+func RegistersToBytes(regs []uint16, order Order) []byte {
+	n := len(regs)
+	b := make([]byte, 2*n)
+
+	for i, r := range regs {
+		w := i
+		if order == OrderCDAB || order == OrderDCBA {
+			w = n - 1 - i
+		}
+
+		hi, lo := byte(r>>8), byte(r)
+		if order == OrderBADC || order == OrderDCBA {
+			hi, lo = lo, hi
+		}
+
+		b[2*w], b[2*w+1] = hi, lo
+	}
+
+	return b
+}
+
+// BytesToRegisters is the reverse of RegistersToBytes, b is big endian value.
+func BytesToRegisters(b []byte, order Order) []uint16 {
+	n := len(b) / 2
+	regs := make([]uint16, n)
+
+	for i := range regs {
+		w := i
+		if order == OrderCDAB || order == OrderDCBA {
+			w = n - 1 - i
+		}
+
+		hi, lo := b[2*w], b[2*w+1]
+		if order == OrderBADC || order == OrderDCBA {
+			hi, lo = lo, hi
+		}
+
+		regs[i] = uint16(hi)<<8 | uint16(lo)
+	}
+
+	return regs
+}
+
+func valueBytes(regs []uint16, n int, order Order) ([]byte, error) {
+	if len(regs) < n {
+		return nil, fmt.Errorf("%w: need %d registers, got %d", ErrBadLength, n, len(regs))
+	}
+	return RegistersToBytes(regs[:n], order), nil
+}
+
+func DecodeUint16(regs []uint16, order Order) (uint16, error) {
+	b, err := valueBytes(regs, 1, order)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func DecodeInt16(regs []uint16, order Order) (int16, error) {
+	v, err := DecodeUint16(regs, order)
+	return int16(v), err
+}
+
+func DecodeUint32(regs []uint16, order Order) (uint32, error) {
+	b, err := valueBytes(regs, 2, order)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func DecodeInt32(regs []uint16, order Order) (int32, error) {
+	v, err := DecodeUint32(regs, order)
+	return int32(v), err
+}
+
+func DecodeFloat32(regs []uint16, order Order) (float32, error) {
+	v, err := DecodeUint32(regs, order)
+	return math.Float32frombits(v), err
+}
+
+func DecodeUint64(regs []uint16, order Order) (uint64, error) {
+	b, err := valueBytes(regs, 4, order)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func DecodeInt64(regs []uint16, order Order) (int64, error) {
+	v, err := DecodeUint64(regs, order)
+	return int64(v), err
+}
+
+func DecodeFloat64(regs []uint16, order Order) (float64, error) {
+	v, err := DecodeUint64(regs, order)
+	return math.Float64frombits(v), err
+}
+
+func EncodeUint16(v uint16, order Order) []uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return BytesToRegisters(b, order)
+}
+
+func EncodeInt16(v int16, order Order) []uint16 {
+	return EncodeUint16(uint16(v), order)
+}
+
+func EncodeUint32(v uint32, order Order) []uint16 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return BytesToRegisters(b, order)
+}
+
+func EncodeInt32(v int32, order Order) []uint16 {
+	return EncodeUint32(uint32(v), order)
+}
+
+func EncodeFloat32(v float32, order Order) []uint16 {
+	return EncodeUint32(math.Float32bits(v), order)
+}
+
+func EncodeUint64(v uint64, order Order) []uint16 {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return BytesToRegisters(b, order)
+}
+
+func EncodeInt64(v int64, order Order) []uint16 {
+	return EncodeUint64(uint64(v), order)
+}
+
+func EncodeFloat64(v float64, order Order) []uint16 {
+	return EncodeUint64(math.Float64bits(v), order)
+}
+
+// DecodeString decodes ascii or utf-8 string from registers.
+func DecodeString(regs []uint16, opts StringOptions) string {
+	b := make([]byte, 0, 2*len(regs))
+
+	for _, r := range regs {
+		if opts.CharPerRegister {
+			b = append(b, byte(r))
+		} else if opts.LowByteFirst {
+			b = append(b, byte(r), byte(r>>8))
+		} else {
+			b = append(b, byte(r>>8), byte(r))
+		}
+	}
+
+	if opts.ZeroTerminated {
+		for i, c := range b {
+			if c == 0 {
+				return string(b[:i])
+			}
+		}
+		return string(b)
+	}
+
+	for len(b) > 0 && (b[len(b)-1] == 0 || b[len(b)-1] == ' ') {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
+
+// EncodeString encodes string to count registers, padding it with zeros.
+func EncodeString(s string, count int, opts StringOptions) ([]uint16, error) {
+	size := 2 * count
+	if opts.CharPerRegister {
+		size = count
+	}
+
+	if len(s) > size {
+		return nil, fmt.Errorf("string length %d does not fit in %d registers", len(s), count)
+	}
+
+	b := make([]byte, size)
+	copy(b, s)
+
+	regs := make([]uint16, count)
+	for i := range regs {
+		if opts.CharPerRegister {
+			regs[i] = uint16(b[i])
+		} else if opts.LowByteFirst {
+			regs[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		} else {
+			regs[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+	}
+
+	return regs, nil
+}
+
+// DecodeBCD decodes binary coded decimal value, 4 digits per register.
+func DecodeBCD(regs []uint16, order Order) (uint64, error) {
+	if len(regs) > 4 {
+		return 0, fmt.Errorf("%w: bcd value can't be longer than 4 registers", ErrBadLength)
+	}
+
+	var res uint64
+	for _, b := range RegistersToBytes(regs, order) {
+		hi, lo := b>>4, b&0xf
+		if hi > 9 || lo > 9 {
+			return 0, fmt.Errorf("invalid bcd byte %#.2x", b)
+		}
+		res = res*100 + uint64(hi)*10 + uint64(lo)
+	}
+
+	return res, nil
+}
+
+// EncodeBCD encodes value as binary coded decimal in count registers.
+func EncodeBCD(v uint64, count int, order Order) ([]uint16, error) {
+	b := make([]byte, 2*count)
+
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v%10) | byte(v/10%10)<<4
+		v /= 100
+	}
+
+	if v != 0 {
+		return nil, fmt.Errorf("value does not fit in %d registers", count)
+	}
+
+	return BytesToRegisters(b, order), nil
+}
+
+// DecodeBits returns bits of the value, least significant bit first.
+func DecodeBits(regs []uint16, order Order) []bool {
+	b := RegistersToBytes(regs, order)
+	res := make([]bool, 8*len(b))
+
+	for i := range res {
+		res[i] = b[len(b)-1-i/8]&(1<<(i%8)) != 0
+	}
+
+	return res
+}
+
+// EncodeBits encodes bits, least significant bit first, to count registers.
+func EncodeBits(bits []bool, count int, order Order) []uint16 {
+	b := make([]byte, 2*count)
+
+	for i, v := range bits {
+		if v && i < 8*len(b) {
+			b[len(b)-1-i/8] |= 1 << (i % 8)
+		}
+	}
+
+	return BytesToRegisters(b, order)
+}
@@ -0,0 +1,105 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestOrders(t *testing.T) {
+	for order, regs := range map[Order][]uint16{
+		OrderABCD: {0x1122, 0x3344},
+		OrderCDAB: {0x3344, 0x1122},
+		OrderBADC: {0x2211, 0x4433},
+		OrderDCBA: {0x4433, 0x2211},
+	} {
+		v, err := DecodeUint32(regs, order)
+		if err != nil {
+			t.Fatalf("error %v", err)
+		}
+
+		if v != 0x11223344 {
+			t.Errorf("%s: got %#x", order, v)
+		}
+
+		enc := EncodeUint32(0x11223344, order)
+		if enc[0] != regs[0] || enc[1] != regs[1] {
+			t.Errorf("%s: encoded %#x", order, enc)
+		}
+	}
+}
+
+func TestFloats(t *testing.T) {
+	f, err := DecodeFloat32([]uint16{0x4049, 0x0fdb}, OrderABCD)
+	if err != nil || f != 3.1415927 {
+		t.Errorf("got %v, %v", f, err)
+	}
+
+	for _, order := range []Order{OrderABCD, OrderCDAB, OrderBADC, OrderDCBA} {
+		d, err := DecodeFloat64(EncodeFloat64(-123.456, order), order)
+		if err != nil || d != -123.456 {
+			t.Errorf("%s: got %v, %v", order, d, err)
+		}
+
+		i, err := DecodeInt64(EncodeInt64(-5, order), order)
+		if err != nil || i != -5 {
+			t.Errorf("%s: got %v, %v", order, i, err)
+		}
+	}
+
+	if _, err := DecodeFloat64([]uint16{1, 2, 3}, OrderABCD); err == nil {
+		t.Errorf("short data passed")
+	}
+}
+
+func TestStrings(t *testing.T) {
+	regs := []uint16{0x4142, 0x4300, 0x4400}
+
+	if s := DecodeString(regs, StringOptions{ZeroTerminated: true}); s != "ABC" {
+		t.Errorf("got %q", s)
+	}
+
+	if s := DecodeString(regs, StringOptions{LowByteFirst: true, ZeroTerminated: true}); s != "BA" {
+		t.Errorf("got %q", s)
+	}
+
+	if s := DecodeString([]uint16{0x57, 0x42, 0}, StringOptions{CharPerRegister: true, ZeroTerminated: true}); s != "WB" {
+		t.Errorf("got %q", s)
+	}
+
+	enc, err := EncodeString("ABC", 3, StringOptions{})
+	if err != nil || enc[0] != 0x4142 || enc[1] != 0x4300 || enc[2] != 0 {
+		t.Errorf("got %#x, %v", enc, err)
+	}
+
+	if s := DecodeString(enc, StringOptions{}); s != "ABC" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestBCD(t *testing.T) {
+	v, err := DecodeBCD([]uint16{0x1234, 0x5678}, OrderABCD)
+	if err != nil || v != 12345678 {
+		t.Errorf("got %d, %v", v, err)
+	}
+
+	if _, err := DecodeBCD([]uint16{0x123a}, OrderABCD); err == nil {
+		t.Errorf("invalid bcd passed")
+	}
+
+	enc, err := EncodeBCD(12345678, 2, OrderCDAB)
+	if err != nil || enc[0] != 0x5678 || enc[1] != 0x1234 {
+		t.Errorf("got %#x, %v", enc, err)
+	}
+}
+
+func TestBits(t *testing.T) {
+	bits := DecodeBits([]uint16{0x8001}, OrderABCD)
+
+	if len(bits) != 16 || !bits[0] || bits[1] || !bits[15] {
+		t.Errorf("got %v", bits)
+	}
+
+	enc := EncodeBits(bits, 1, OrderBADC)
+	if enc[0] != 0x0180 {
+		t.Errorf("got %#x", enc)
+	}
+}
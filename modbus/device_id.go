@@ -0,0 +1,140 @@
+package modbus
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	MEITypeReadDeviceId = 0x0e
+
+	ReadDeviceIdBasic    = 1
+	ReadDeviceIdRegular  = 2
+	ReadDeviceIdExtended = 3
+	ReadDeviceIdSpecific = 4
+
+	ObjectIdVendorName          = 0
+	ObjectIdProductCode         = 1
+	ObjectIdMajorMinorRevision  = 2
+	ObjectIdVendorUrl           = 3
+	ObjectIdProductName         = 4
+	ObjectIdModelName           = 5
+	ObjectIdUserApplicationName = 6
+
+	// regular identification, stream and individual access
+	ConformityLevelRegular = 0x82
+)
+
+type DeviceIdentification struct {
+	Code         byte
+	Conformity   byte
+	MoreFollows  bool
+	NextObjectId byte
+	Objects      map[byte]string
+}
+
+func ReadDeviceIdentification(slaveId byte, code byte, objectId byte) *ProtocolDataUnit {
+	return &ProtocolDataUnit{
+		SlaveId:      slaveId,
+		FunctionCode: FuncCodeEncapsulatedInterfaceTransport,
+		Data:         []byte{MEITypeReadDeviceId, code, objectId},
+	}
+}
+
+func DecodeDeviceIdentification(pdu *ProtocolDataUnit) (*DeviceIdentification, error) {
+	if pdu.FunctionCode != FuncCodeEncapsulatedInterfaceTransport {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) < 6 || pdu.Data[0] != MEITypeReadDeviceId {
+		return nil, fmt.Errorf("%w: not a device identification response", ErrBadPayload)
+	}
+
+	res := &DeviceIdentification{
+		Code:         pdu.Data[1],
+		Conformity:   pdu.Data[2],
+		MoreFollows:  pdu.Data[3] == 0xff,
+		NextObjectId: pdu.Data[4],
+		Objects:      make(map[byte]string),
+	}
+
+	num := int(pdu.Data[5])
+	data := pdu.Data[6:]
+
+	for i := 0; i < num; i++ {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, fmt.Errorf("%w: object %d is too short", ErrBadPayload, i)
+		}
+		res.Objects[data[0]] = string(data[2 : 2+data[1]])
+		data = data[2+data[1]:]
+	}
+
+	return res, nil
+}
+
+// MakeDeviceIdentificationResponse makes the answer to read device identification request from the objects.
+// Objects that don't fit in one pdu are sent with "more follows" flag.
+func MakeDeviceIdentificationResponse(req *ProtocolDataUnit, conformity byte, objects map[byte]string) *ProtocolDataUnit {
+	if len(req.Data) != 3 || req.Data[0] != MEITypeReadDeviceId {
+		return NewModbusError(req, ExceptionCodeIllegalDataValue)
+	}
+
+	code, objectId := req.Data[1], req.Data[2]
+
+	var ids []int
+	switch code {
+	case ReadDeviceIdSpecific:
+		if _, ok := objects[objectId]; !ok {
+			return NewModbusError(req, ExceptionCodeIllegalDataAddress)
+		}
+		ids = []int{int(objectId)}
+	case ReadDeviceIdBasic, ReadDeviceIdRegular, ReadDeviceIdExtended:
+		lo, hi := 0, int(ObjectIdMajorMinorRevision)
+		if code == ReadDeviceIdRegular {
+			hi = 0x7f
+		} else if code == ReadDeviceIdExtended {
+			hi = 0xff
+		}
+
+		for id := range objects {
+			if int(id) >= lo && int(id) <= hi {
+				ids = append(ids, int(id))
+			}
+		}
+		sort.Ints(ids)
+
+		// start from the requested object, or from the beginning if there is no such object
+		if _, ok := objects[objectId]; ok && int(objectId) <= hi {
+			for len(ids) > 0 && ids[0] < int(objectId) {
+				ids = ids[1:]
+			}
+		}
+	default:
+		return NewModbusError(req, ExceptionCodeIllegalDataValue)
+	}
+
+	pdu := &ProtocolDataUnit{SlaveId: req.SlaveId, FunctionCode: FuncCodeEncapsulatedInterfaceTransport}
+	pdu.Data = []byte{MEITypeReadDeviceId, code, conformity, 0, 0, 0}
+
+	// slave id, fn and crc must fit in rtu frame
+	maxLen := RtuMaxSize - 4
+
+	for _, id := range ids {
+		val := objects[byte(id)]
+		if len(val) > maxLen-8 {
+			val = val[:maxLen-8]
+		}
+
+		if len(pdu.Data)+2+len(val) > maxLen && pdu.Data[5] > 0 {
+			pdu.Data[3] = 0xff
+			pdu.Data[4] = byte(id)
+			break
+		}
+
+		pdu.Data = append(pdu.Data, byte(id), byte(len(val)))
+		pdu.Data = append(pdu.Data, val...)
+		pdu.Data[5]++
+	}
+
+	return pdu
+}
@@ -0,0 +1,71 @@
+package modbus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeviceIdentification(t *testing.T) {
+	objects := map[byte]string{
+		ObjectIdVendorName:         "vendor",
+		ObjectIdProductCode:        "code",
+		ObjectIdMajorMinorRevision: "1.0",
+		ObjectIdProductName:        "name",
+	}
+
+	ans := MakeDeviceIdentificationResponse(ReadDeviceIdentification(1, ReadDeviceIdBasic, 0), ConformityLevelRegular, objects)
+
+	res, err := DecodeDeviceIdentification(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if len(res.Objects) != 3 || res.MoreFollows || res.Objects[ObjectIdProductCode] != "code" {
+		t.Errorf("wrong response %v", res)
+	}
+
+	ans = MakeDeviceIdentificationResponse(ReadDeviceIdentification(1, ReadDeviceIdSpecific, ObjectIdProductName), ConformityLevelRegular, objects)
+
+	res, err = DecodeDeviceIdentification(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if len(res.Objects) != 1 || res.Objects[ObjectIdProductName] != "name" {
+		t.Errorf("wrong response %v", res)
+	}
+
+	ans = MakeDeviceIdentificationResponse(ReadDeviceIdentification(1, ReadDeviceIdSpecific, ObjectIdModelName), ConformityLevelRegular, objects)
+	if ans.FunctionCode&0x80 == 0 || ans.Data[0] != ExceptionCodeIllegalDataAddress {
+		t.Errorf("expected exception, got %v", ans)
+	}
+}
+
+func TestDeviceIdentificationMoreFollows(t *testing.T) {
+	objects := map[byte]string{
+		ObjectIdVendorName:  strings.Repeat("a", 200),
+		ObjectIdProductCode: strings.Repeat("b", 200),
+	}
+
+	ans := MakeDeviceIdentificationResponse(ReadDeviceIdentification(1, ReadDeviceIdBasic, 0), ConformityLevelRegular, objects)
+
+	res, err := DecodeDeviceIdentification(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if !res.MoreFollows || res.NextObjectId != ObjectIdProductCode || len(res.Objects) != 1 {
+		t.Fatalf("wrong response %v", res)
+	}
+
+	ans = MakeDeviceIdentificationResponse(ReadDeviceIdentification(1, ReadDeviceIdBasic, res.NextObjectId), ConformityLevelRegular, objects)
+
+	res, err = DecodeDeviceIdentification(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if res.MoreFollows || len(res.Objects) != 1 || res.Objects[ObjectIdProductCode] != objects[ObjectIdProductCode] {
+		t.Fatalf("wrong response %v", res)
+	}
+}
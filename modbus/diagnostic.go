@@ -0,0 +1,120 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	DiagReturnQueryData                = 0x00
+	DiagRestartCommunications          = 0x01
+	DiagReturnDiagnosticRegister       = 0x02
+	DiagForceListenOnly                = 0x04
+	DiagClearCounters                  = 0x0a
+	DiagReturnBusMessageCount          = 0x0b
+	DiagReturnBusCommErrorCount        = 0x0c
+	DiagReturnBusExceptionErrorCount   = 0x0d
+	DiagReturnServerMessageCount       = 0x0e
+	DiagReturnServerNoResponseCount    = 0x0f
+	DiagReturnServerNAKCount           = 0x10
+	DiagReturnServerBusyCount          = 0x11
+	DiagReturnBusCharacterOverrunCount = 0x12
+	DiagClearOverrunCounter            = 0x14
+)
+
+// DiagCounters are counter sub-functions with their names.
+var DiagCounters = []struct {
+	SubFunction uint16
+	Name        string
+}{
+	{DiagReturnBusMessageCount, "bus messages"},
+	{DiagReturnBusCommErrorCount, "bus communication errors (crc)"},
+	{DiagReturnBusExceptionErrorCount, "bus exceptions"},
+	{DiagReturnServerMessageCount, "slave messages"},
+	{DiagReturnServerNoResponseCount, "slave no responses"},
+	{DiagReturnServerNAKCount, "slave NAKs"},
+	{DiagReturnServerBusyCount, "slave busy"},
+	{DiagReturnBusCharacterOverrunCount, "bus character overruns"},
+}
+
+func Diagnostic(slaveId byte, subFunction uint16, data []byte) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeDiagnostic}
+	pdu.Data = make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(pdu.Data, subFunction)
+	copy(pdu.Data[2:], data)
+	return
+}
+
+func ReturnQueryData(slaveId byte, data []byte) *ProtocolDataUnit {
+	return Diagnostic(slaveId, DiagReturnQueryData, data)
+}
+
+func RestartCommunications(slaveId byte, clearLog bool) *ProtocolDataUnit {
+	if clearLog {
+		return Diagnostic(slaveId, DiagRestartCommunications, []byte{0xff, 0})
+	}
+	return Diagnostic(slaveId, DiagRestartCommunications, []byte{0, 0})
+}
+
+// DiagnosticCounter makes request for counter sub-functions, diagnostic register and clear counters.
+func DiagnosticCounter(slaveId byte, subFunction uint16) *ProtocolDataUnit {
+	return Diagnostic(slaveId, subFunction, []byte{0, 0})
+}
+
+func ForceListenOnly(slaveId byte) *ProtocolDataUnit {
+	return Diagnostic(slaveId, DiagForceListenOnly, []byte{0, 0})
+}
+
+// IsForceListenOnly returns true for force listen only request, the slave does not answer it.
+func IsForceListenOnly(pdu *ProtocolDataUnit) bool {
+	sub, _, err := DecodeDiagnostic(pdu)
+	return err == nil && sub == DiagForceListenOnly
+}
+
+// DecodeDiagnostic returns sub-function and data from diagnostic request or response.
+func DecodeDiagnostic(pdu *ProtocolDataUnit) (subFunction uint16, data []byte, err error) {
+	if pdu.FunctionCode != FuncCodeDiagnostic {
+		err = fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+		return
+	}
+
+	if len(pdu.Data) < 2 {
+		err = fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+		return
+	}
+
+	subFunction = binary.BigEndian.Uint16(pdu.Data)
+	data = pdu.Data[2:]
+	return
+}
+
+// DecodeDiagnosticCounter returns counter or diagnostic register value from the response.
+func DecodeDiagnosticCounter(pdu *ProtocolDataUnit, subFunction uint16) (uint16, error) {
+	sub, data, err := DecodeDiagnostic(pdu)
+	if err != nil {
+		return 0, err
+	}
+
+	if sub != subFunction {
+		return 0, fmt.Errorf("wrong sub-function %#x, expected %#x", sub, subFunction)
+	}
+
+	if len(data) != 2 {
+		return 0, fmt.Errorf("%w: data length %d", ErrBadPayload, len(data))
+	}
+
+	return binary.BigEndian.Uint16(data), nil
+}
+
+// checkDiagnosticEcho checks that response is the echo of the request.
+func checkDiagnosticEcho(req *ProtocolDataUnit, resp *ProtocolDataUnit) error {
+	if _, _, err := DecodeDiagnostic(resp); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(req.Data, resp.Data) {
+		return fmt.Errorf("wrong echo: %x, expected %x", resp.Data, req.Data)
+	}
+	return nil
+}
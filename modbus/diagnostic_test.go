@@ -0,0 +1,41 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestDiagnosticCounter(t *testing.T) {
+	req := DiagnosticCounter(1, DiagReturnBusCommErrorCount)
+
+	adu, _ := req.MakeRtu()
+	if l := calculateResponseLength(adu); l != len(adu) {
+		t.Errorf("expected response length %d, got %d", len(adu), l)
+	}
+
+	resp := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeDiagnostic, Data: []byte{0, DiagReturnBusCommErrorCount, 0x01, 0x02}}
+
+	v, err := DecodeDiagnosticCounter(resp, DiagReturnBusCommErrorCount)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if v != 0x102 {
+		t.Errorf("wrong counter %d", v)
+	}
+
+	if _, err := DecodeDiagnosticCounter(resp, DiagReturnBusMessageCount); err == nil {
+		t.Errorf("wrong sub-function passed")
+	}
+}
+
+func TestReturnQueryData(t *testing.T) {
+	req := ReturnQueryData(1, []byte{0xa5, 0x37})
+
+	if err := checkDiagnosticEcho(req, &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeDiagnostic, Data: []byte{0, 0, 0xa5, 0x37}}); err != nil {
+		t.Errorf("error %v", err)
+	}
+
+	if err := checkDiagnosticEcho(req, &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeDiagnostic, Data: []byte{0, 0, 0xa5, 0x38}}); err == nil {
+		t.Errorf("wrong echo passed")
+	}
+}
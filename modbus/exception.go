@@ -0,0 +1,82 @@
+package modbus
+
+import (
+	"fmt"
+)
+
+// ExceptionError is the modbus exception answer as an error.
+// Sentinel errors have zero slave id and function, so errors.Is matches them by exception code only.
+type ExceptionError struct {
+	SlaveId       byte
+	FunctionCode  byte
+	ExceptionCode byte
+}
+
+var (
+	ErrIllegalFunction         = &ExceptionError{ExceptionCode: ExceptionCodeIllegalFunction}
+	ErrIllegalDataAddress      = &ExceptionError{ExceptionCode: ExceptionCodeIllegalDataAddress}
+	ErrIllegalDataValue        = &ExceptionError{ExceptionCode: ExceptionCodeIllegalDataValue}
+	ErrServerDeviceFailure     = &ExceptionError{ExceptionCode: ExceptionCodeServerDeviceFailure}
+	ErrAcknowledge             = &ExceptionError{ExceptionCode: ExceptionCodeAcknowledge}
+	ErrServerDeviceBusy        = &ExceptionError{ExceptionCode: ExceptionCodeServerDeviceBusy}
+	ErrMemoryParityError       = &ExceptionError{ExceptionCode: ExceptionCodeMemoryParityError}
+	ErrGatewayPathUnavailable  = &ExceptionError{ExceptionCode: ExceptionCodeGatewayPathUnavailable}
+	ErrGatewayTargetNoResponse = &ExceptionError{ExceptionCode: ExceptionCodeGatewayTargetDeviceFailedToRespond}
+)
+
+func (e *ExceptionError) Error() string {
+	if e.FunctionCode == 0 {
+		return fmt.Sprintf("modbus: exception %#.2x (%s)", e.ExceptionCode, exceptionText(e.ExceptionCode))
+	}
+	return fmt.Sprintf("modbus: exception %#.2x (%s), slave_id: %d, fn: %#.2x",
+		e.ExceptionCode, exceptionText(e.ExceptionCode), e.SlaveId, e.FunctionCode)
+}
+
+func (e *ExceptionError) Is(target error) bool {
+	t, ok := target.(*ExceptionError)
+	if !ok {
+		return false
+	}
+
+	return t.ExceptionCode == e.ExceptionCode &&
+		(t.SlaveId == 0 || t.SlaveId == e.SlaveId) &&
+		(t.FunctionCode == 0 || t.FunctionCode == e.FunctionCode)
+}
+
+// Err returns *ExceptionError for exception answer and nil otherwise.
+func (pdu *ProtocolDataUnit) Err() error {
+	if pdu.FunctionCode&0x80 == 0 {
+		return nil
+	}
+
+	e := &ExceptionError{SlaveId: pdu.SlaveId, FunctionCode: pdu.FunctionCode & 0x7f}
+	if len(pdu.Data) > 0 {
+		e.ExceptionCode = pdu.Data[0]
+	}
+	return e
+}
+
+func exceptionText(code byte) string {
+	switch code {
+	case ExceptionCodeIllegalFunction:
+		return "Illegal function"
+	case ExceptionCodeIllegalDataAddress:
+		return "Illegal data address"
+	case ExceptionCodeIllegalDataValue:
+		return "Illegal data value"
+	case ExceptionCodeServerDeviceFailure:
+		return "server device failure"
+	case ExceptionCodeAcknowledge:
+		return "Ack"
+	case ExceptionCodeServerDeviceBusy:
+		return "Device busy"
+	case ExceptionCodeMemoryParityError:
+		return "Memory parity error"
+	case ExceptionCodeGatewayPathUnavailable:
+		return "Gateway path unavailable"
+	case ExceptionCodeGatewayTargetDeviceFailedToRespond:
+		return "Gateway target device failed to respond"
+	default:
+		return fmt.Sprintf("Unknown code %x", code)
+	}
+}
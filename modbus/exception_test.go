@@ -0,0 +1,32 @@
+package modbus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExceptionError(t *testing.T) {
+	pdu := NewModbusError(ReadHoldingRegisters(5, 0, 1), ExceptionCodeGatewayTargetDeviceFailedToRespond)
+
+	err := pdu.Err()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !errors.Is(err, ErrGatewayTargetNoResponse) {
+		t.Errorf("expected ErrGatewayTargetNoResponse, got %v", err)
+	}
+
+	if errors.Is(err, ErrIllegalDataAddress) {
+		t.Errorf("must not be ErrIllegalDataAddress")
+	}
+
+	var e *ExceptionError
+	if !errors.As(err, &e) || e.SlaveId != 5 || e.FunctionCode != FuncCodeReadHoldingRegisters {
+		t.Errorf("wrong error %v", err)
+	}
+
+	if ReadHoldingRegisters(5, 0, 1).Err() != nil {
+		t.Errorf("no error expected")
+	}
+}
@@ -0,0 +1,21 @@
+package modbus
+
+type lrc struct {
+	sum byte
+}
+
+func (lrc *lrc) reset() *lrc {
+	lrc.sum = 0
+	return lrc
+}
+
+func (lrc *lrc) pushBytes(bs []byte) *lrc {
+	for _, b := range bs {
+		lrc.sum += b
+	}
+	return lrc
+}
+
+func (lrc *lrc) value() byte {
+	return byte(-int8(lrc.sum))
+}
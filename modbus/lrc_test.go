@@ -0,0 +1,15 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestLRC(t *testing.T) {
+	var lrc lrc
+	lrc.reset()
+	lrc.pushBytes([]byte{0x01, 0x03, 0x00, 0x01, 0x00, 0x01})
+
+	if 0xfa != lrc.value() {
+		t.Fatalf("lrc expected %v, actual %v", 0xfa, lrc.value())
+	}
+}
@@ -0,0 +1,373 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// field is the parsed `modbus` struct tag, e.g. `modbus:"offset=4,type=float32,order=cdab,scale=0.1"`.
+// Keys:
+//
+//	offset   - register offset from the start of the block
+//	type     - uint16, int16, uint32, int32, float32, uint64, int64, float64, string, bcd, bits, bit
+//	order    - abcd (default), cdab, badc, dcba
+//	scale    - value = raw * scale
+//	len      - number of registers for string, bcd and bits
+//	bit      - bit number for bit type
+//	lowfirst - string has first char in low byte
+//	zero     - string is zero terminated
+//	char     - string has one char per register
+type field struct {
+	index  int
+	offset int
+	typ    string
+	order  Order
+	scale  float64
+	count  int
+	bit    int
+	str    StringOptions
+}
+
+func (f *field) size() int {
+	switch f.typ {
+	case "uint32", "int32", "float32":
+		return 2
+	case "uint64", "int64", "float64":
+		return 4
+	case "string", "bcd", "bits":
+		return f.count
+	default:
+		return 1
+	}
+}
+
+func defaultType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Uint16, reflect.Int16, reflect.Uint32, reflect.Int32, reflect.Float32,
+		reflect.Uint64, reflect.Int64, reflect.Float64, reflect.String:
+		return t.Kind().String()
+	case reflect.Bool:
+		return "bit"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Bool {
+			return "bits"
+		}
+	}
+	return ""
+}
+
+func parseField(sf reflect.StructField, tag string) (*field, error) {
+	f := &field{typ: defaultType(sf.Type), scale: 1, count: 1}
+
+	for _, part := range strings.Split(tag, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		var err error
+		switch k {
+		case "offset":
+			f.offset, err = strconv.Atoi(v)
+		case "type":
+			f.typ = v
+		case "order":
+			f.order, err = ParseOrder(v)
+		case "scale":
+			f.scale, err = strconv.ParseFloat(v, 64)
+		case "len":
+			f.count, err = strconv.Atoi(v)
+		case "bit":
+			f.bit, err = strconv.Atoi(v)
+		case "lowfirst":
+			f.str.LowByteFirst = true
+		case "zero":
+			f.str.ZeroTerminated = true
+		case "char":
+			f.str.CharPerRegister = true
+		case "":
+		default:
+			err = fmt.Errorf("unknown key %s", k)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+	}
+
+	if f.typ == "" {
+		return nil, fmt.Errorf("field %s: no type for %s", sf.Name, sf.Type)
+	}
+
+	if f.offset < 0 || f.count < 1 || f.bit < 0 || f.bit > 15 || f.scale == 0 {
+		return nil, fmt.Errorf("field %s: invalid tag %q", sf.Name, tag)
+	}
+
+	return f, nil
+}
+
+func structFields(v any) (reflect.Value, []*field, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return rv, nil, fmt.Errorf("modbus: nil pointer")
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return rv, nil, fmt.Errorf("modbus: %s is not a struct", rv.Type())
+	}
+
+	var fields []*field
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		tag, ok := sf.Tag.Lookup("modbus")
+		if !ok || tag == "-" || !sf.IsExported() {
+			continue
+		}
+
+		f, err := parseField(sf, tag)
+		if err != nil {
+			return rv, nil, fmt.Errorf("modbus: %w", err)
+		}
+		f.index = i
+		fields = append(fields, f)
+	}
+
+	return rv, fields, nil
+}
+
+// RegisterSpan returns number of registers needed for the struct.
+func RegisterSpan(v any) (int, error) {
+	_, fields, err := structFields(v)
+	if err != nil {
+		return 0, err
+	}
+
+	span := 0
+	for _, f := range fields {
+		if end := f.offset + f.size(); end > span {
+			span = end
+		}
+	}
+	return span, nil
+}
+
+// Unmarshal decodes registers into the struct pointed by v, using `modbus` field tags.
+func Unmarshal(regs []uint16, v any) error {
+	rv, fields, err := structFields(v)
+	if err != nil {
+		return err
+	}
+
+	if !rv.CanSet() {
+		return fmt.Errorf("modbus: unmarshal needs a pointer to struct")
+	}
+
+	for _, f := range fields {
+		if f.offset+f.size() > len(regs) {
+			return fmt.Errorf("%w: field %s needs registers up to %d, got %d", ErrBadLength, rv.Type().Field(f.index).Name, f.offset+f.size(), len(regs))
+		}
+
+		if err := f.decode(regs[f.offset:f.offset+f.size()], rv.Field(f.index)); err != nil {
+			return fmt.Errorf("modbus: field %s: %w", rv.Type().Field(f.index).Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Marshal encodes the struct into registers, using `modbus` field tags.
+// Registers not covered by any field are zero.
+func Marshal(v any) ([]uint16, error) {
+	rv, fields, err := structFields(v)
+	if err != nil {
+		return nil, err
+	}
+
+	span, _ := RegisterSpan(v)
+	regs := make([]uint16, span)
+
+	for _, f := range fields {
+		vals, err := f.encode(rv.Field(f.index), regs[f.offset:f.offset+f.size()])
+		if err != nil {
+			return nil, fmt.Errorf("modbus: field %s: %w", rv.Type().Field(f.index).Name, err)
+		}
+		copy(regs[f.offset:], vals)
+	}
+
+	return regs, nil
+}
+
+func (f *field) decode(regs []uint16, fv reflect.Value) error {
+	switch f.typ {
+	case "string":
+		if fv.Kind() != reflect.String {
+			return fmt.Errorf("can't set string to %s", fv.Type())
+		}
+		fv.SetString(DecodeString(regs, f.str))
+		return nil
+
+	case "bits":
+		if fv.Kind() != reflect.Slice || fv.Type().Elem().Kind() != reflect.Bool {
+			return fmt.Errorf("can't set bits to %s", fv.Type())
+		}
+		fv.Set(reflect.ValueOf(DecodeBits(regs, f.order)))
+		return nil
+
+	case "bit":
+		if fv.Kind() != reflect.Bool {
+			return fmt.Errorf("can't set bit to %s", fv.Type())
+		}
+		fv.SetBool(regs[0]&(1<<f.bit) != 0)
+		return nil
+	}
+
+	// value as integer (bits of uint64 are kept) and as float
+	var n int64
+	var fl float64
+	isFloat := false
+
+	var err error
+	switch f.typ {
+	case "uint16":
+		var v uint16
+		v, err = DecodeUint16(regs, f.order)
+		n, fl = int64(v), float64(v)
+	case "int16":
+		var v int16
+		v, err = DecodeInt16(regs, f.order)
+		n, fl = int64(v), float64(v)
+	case "uint32":
+		var v uint32
+		v, err = DecodeUint32(regs, f.order)
+		n, fl = int64(v), float64(v)
+	case "int32":
+		var v int32
+		v, err = DecodeInt32(regs, f.order)
+		n, fl = int64(v), float64(v)
+	case "float32":
+		var v float32
+		v, err = DecodeFloat32(regs, f.order)
+		fl, isFloat = float64(v), true
+	case "uint64", "bcd":
+		var v uint64
+		if f.typ == "bcd" {
+			v, err = DecodeBCD(regs, f.order)
+		} else {
+			v, err = DecodeUint64(regs, f.order)
+		}
+		n, fl = int64(v), float64(v)
+	case "int64":
+		n, err = DecodeInt64(regs, f.order)
+		fl = float64(n)
+	case "float64":
+		fl, err = DecodeFloat64(regs, f.order)
+		isFloat = true
+	default:
+		return fmt.Errorf("unknown type %s", f.typ)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	exact := f.scale == 1 && !isFloat
+	fl *= f.scale
+
+	switch fv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		fv.SetFloat(fl)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if exact {
+			fv.SetInt(n)
+		} else {
+			fv.SetInt(int64(math.Round(fl)))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if exact {
+			fv.SetUint(uint64(n))
+		} else {
+			fv.SetUint(uint64(math.Round(fl)))
+		}
+	default:
+		return fmt.Errorf("can't set %s to %s", f.typ, fv.Type())
+	}
+
+	return nil
+}
+
+func (f *field) encode(fv reflect.Value, cur []uint16) ([]uint16, error) {
+	switch f.typ {
+	case "string":
+		if fv.Kind() != reflect.String {
+			return nil, fmt.Errorf("can't get string from %s", fv.Type())
+		}
+		return EncodeString(fv.String(), f.count, f.str)
+
+	case "bits":
+		if fv.Kind() != reflect.Slice || fv.Type().Elem().Kind() != reflect.Bool {
+			return nil, fmt.Errorf("can't get bits from %s", fv.Type())
+		}
+		return EncodeBits(fv.Interface().([]bool), f.count, f.order), nil
+
+	case "bit":
+		if fv.Kind() != reflect.Bool {
+			return nil, fmt.Errorf("can't get bit from %s", fv.Type())
+		}
+		// several bit fields can share one register
+		v := cur[0] &^ (1 << f.bit)
+		if fv.Bool() {
+			v |= 1 << f.bit
+		}
+		return []uint16{v}, nil
+	}
+
+	// raw value = value / scale, as integer (bits of uint64 are kept) and as float
+	var n int64
+	var fl float64
+
+	switch fv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		fl = fv.Float() / f.scale
+		n = int64(math.Round(fl))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = fv.Int()
+		fl = float64(n) / f.scale
+		if f.scale != 1 {
+			n = int64(math.Round(fl))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = int64(fv.Uint())
+		fl = float64(fv.Uint()) / f.scale
+		if f.scale != 1 {
+			n = int64(math.Round(fl))
+		}
+	default:
+		return nil, fmt.Errorf("can't get %s from %s", f.typ, fv.Type())
+	}
+
+	switch f.typ {
+	case "uint16":
+		return EncodeUint16(uint16(n), f.order), nil
+	case "int16":
+		return EncodeInt16(int16(n), f.order), nil
+	case "uint32":
+		return EncodeUint32(uint32(n), f.order), nil
+	case "int32":
+		return EncodeInt32(int32(n), f.order), nil
+	case "float32":
+		return EncodeFloat32(float32(fl), f.order), nil
+	case "uint64":
+		return EncodeUint64(uint64(n), f.order), nil
+	case "int64":
+		return EncodeInt64(n, f.order), nil
+	case "float64":
+		return EncodeFloat64(fl, f.order), nil
+	case "bcd":
+		return EncodeBCD(uint64(n), f.count, f.order)
+	default:
+		return nil, fmt.Errorf("unknown type %s", f.typ)
+	}
+}
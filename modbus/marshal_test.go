@@ -0,0 +1,75 @@
+package modbus
+
+import (
+	"testing"
+)
+
+type meter struct {
+	Voltage float64 `modbus:"offset=0,type=uint16,scale=0.1"`
+	Power   float32 `modbus:"offset=1,order=cdab"`
+	Energy  uint64  `modbus:"offset=3,type=uint32"`
+	Temp    int16   `modbus:"offset=5"`
+	Model   string  `modbus:"offset=6,len=3,zero"`
+	Serial  uint32  `modbus:"offset=9,type=bcd,len=2"`
+	Alarm   bool    `modbus:"offset=11,bit=2"`
+	Running bool    `modbus:"offset=11,bit=0"`
+	Ignored int
+}
+
+func TestUnmarshal(t *testing.T) {
+	regs := []uint16{2305, 0x0fdb, 0x4049, 0x0001, 0x0002, 0xfffe, 0x4142, 0x4300, 0, 0x1234, 0x5678, 0x5}
+
+	var m meter
+	if err := Unmarshal(regs, &m); err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if m.Voltage < 230.49 || m.Voltage > 230.51 {
+		t.Errorf("wrong voltage %v", m.Voltage)
+	}
+	if m.Power != 3.1415927 {
+		t.Errorf("wrong power %v", m.Power)
+	}
+	if m.Energy != 0x10002 {
+		t.Errorf("wrong energy %v", m.Energy)
+	}
+	if m.Temp != -2 {
+		t.Errorf("wrong temp %v", m.Temp)
+	}
+	if m.Model != "ABC" {
+		t.Errorf("wrong model %q", m.Model)
+	}
+	if m.Serial != 12345678 {
+		t.Errorf("wrong serial %v", m.Serial)
+	}
+	if !m.Alarm || !m.Running {
+		t.Errorf("wrong bits %v %v", m.Alarm, m.Running)
+	}
+
+	res, err := Marshal(&m)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if len(res) != len(regs) {
+		t.Fatalf("wrong length %d", len(res))
+	}
+
+	for i := range regs {
+		if res[i] != regs[i] {
+			t.Errorf("reg %d: got %#x, expected %#x", i, res[i], regs[i])
+		}
+	}
+
+	if span, _ := RegisterSpan(meter{}); span != 12 {
+		t.Errorf("wrong span %d", span)
+	}
+
+	if err := Unmarshal(regs[:5], &m); err == nil {
+		t.Errorf("short data passed")
+	}
+
+	if err := Unmarshal(regs, m); err == nil {
+		t.Errorf("non pointer passed")
+	}
+}
@@ -1,8 +1,12 @@
 package modbus
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -48,10 +52,44 @@ const (
 	RtuMaxSize       = 256
 	RtuExceptionSize = 5
 
+	MaxFIFOCount = 31
+
+	FileRecordRefType = 6
+
+	// PduMaxSize is the maximal size of function code and data
+	PduMaxSize = 253
+
 	TcpHeaderSize = 7
 	TcpMaxLength  = 260
+
+	AsciiMinSize = 9
+	AsciiMaxSize = 513
 )
 
+var (
+	ErrShortFrame    = errors.New("modbus: frame is too short")
+	ErrBadProtocolID = errors.New("modbus: bad protocol id")
+	ErrBadLength     = errors.New("modbus: bad length")
+	ErrCRCMismatch   = errors.New("modbus: crc mismatch")
+	ErrLRCMismatch   = errors.New("modbus: lrc mismatch")
+	ErrBadPayload    = errors.New("modbus: bad payload")
+	ErrTimeout       = errors.New("modbus: timeout")
+	ErrEchoMismatch  = errors.New("modbus: echo mismatch")
+	ErrBadSlaveId    = errors.New("modbus: answer from wrong slave")
+	ErrBadFunction   = errors.New("modbus: answer to wrong function")
+	ErrBadWriteEcho  = errors.New("modbus: write answer does not match request")
+	ErrNotConnected  = errors.New("modbus: port is not connected")
+)
+
+// FileRecord is a file record sub-request. Length is used for read requests only,
+// for writes it is the length of Values.
+type FileRecord struct {
+	File   uint16
+	Record uint16
+	Length uint16
+	Values []uint16
+}
+
 type ProtocolDataUnit struct {
 	SlaveId      byte
 	FunctionCode byte
@@ -96,6 +134,36 @@ func (pdu *ProtocolDataUnit) ReqString() string {
 	case FuncCodeWriteMultipleRegisters:
 		name = fmt.Sprintf("write registers, addr %#x, num %d", binary.BigEndian.Uint16(pdu.Data[0:]), binary.BigEndian.Uint16(pdu.Data[2:]))
 
+	case FuncCodeReadFileRecord:
+		name = fmt.Sprintf("read file record, %d bytes", pdu.Data[0])
+	case FuncCodeWriteFileRecord:
+		name = fmt.Sprintf("write file record, %d bytes", pdu.Data[0])
+	case FuncCodeReadExceptionStatus:
+		name = "read exception status"
+	case FuncCodeGetComEventCounter:
+		name = "get comm event counter"
+	case FuncCodeGetComEventLog:
+		name = "get comm event log"
+	case FuncCodeReportSlaveId:
+		name = "report slave id"
+	case FuncCodeDiagnostic:
+		name = fmt.Sprintf("diagnostic, sub-function %#.4x", binary.BigEndian.Uint16(pdu.Data[0:]))
+	case FuncCodeEncapsulatedInterfaceTransport:
+		if len(pdu.Data) == 3 && pdu.Data[0] == MEITypeReadDeviceId {
+			name = fmt.Sprintf("read device identification, code %d, object %#x", pdu.Data[1], pdu.Data[2])
+		} else {
+			name = fmt.Sprintf("encapsulated interface transport, mei %#x", pdu.Data[0])
+		}
+	case FuncCodeReadFIFOQueue:
+		name = fmt.Sprintf("read fifo queue, addr %#x", binary.BigEndian.Uint16(pdu.Data[0:]))
+	case FuncCodeMaskWriteRegister:
+		name = fmt.Sprintf("mask write register, addr %#x, and %#.4x, or %#.4x",
+			binary.BigEndian.Uint16(pdu.Data[0:]), binary.BigEndian.Uint16(pdu.Data[2:]), binary.BigEndian.Uint16(pdu.Data[4:]))
+	case FuncCodeReadWriteMultipleRegisters:
+		name = fmt.Sprintf("read/write registers, read addr %#x, num %d, write addr %#x, num %d",
+			binary.BigEndian.Uint16(pdu.Data[0:]), binary.BigEndian.Uint16(pdu.Data[2:]),
+			binary.BigEndian.Uint16(pdu.Data[4:]), binary.BigEndian.Uint16(pdu.Data[6:]))
+
 	default:
 		name = "unknown"
 	}
@@ -116,28 +184,7 @@ func (pdu *ProtocolDataUnit) ErrString() string {
 		return "?"
 	}
 
-	switch pdu.Data[0] {
-	case ExceptionCodeIllegalFunction:
-		return "Illegal function"
-	case ExceptionCodeIllegalDataAddress:
-		return "Illegal data address"
-	case ExceptionCodeIllegalDataValue:
-		return "Illegal data value"
-	case ExceptionCodeServerDeviceFailure:
-		return "server device failure"
-	case ExceptionCodeAcknowledge:
-		return "Ack"
-	case ExceptionCodeServerDeviceBusy:
-		return "Device busy"
-	case ExceptionCodeMemoryParityError:
-		return "Memory parity error"
-	case ExceptionCodeGatewayPathUnavailable:
-		return "Gateway path unavailable"
-	case ExceptionCodeGatewayTargetDeviceFailedToRespond:
-		return "Gateway target device failed to respond"
-	default:
-		return fmt.Sprintf("Unknown code %x", pdu.Data[0])
-	}
+	return exceptionText(pdu.Data[0])
 }
 
 func readManyPDU(slaveId byte, fn byte, addr uint16, count uint16) (pdu *ProtocolDataUnit) {
@@ -215,6 +262,166 @@ func WriteMultipleRegisters(slaveId byte, addr uint16, count uint16, values []ui
 	return
 }
 
+func MaskWriteRegister(slaveId byte, addr uint16, andMask uint16, orMask uint16) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeMaskWriteRegister}
+	pdu.Data = make([]byte, 6)
+	binary.BigEndian.PutUint16(pdu.Data, addr)
+	binary.BigEndian.PutUint16(pdu.Data[2:], andMask)
+	binary.BigEndian.PutUint16(pdu.Data[4:], orMask)
+	return
+}
+
+func ReadFileRecord(slaveId byte, records []FileRecord) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReadFileRecord}
+	pdu.Data = make([]byte, 1+7*len(records))
+	pdu.Data[0] = byte(7 * len(records))
+
+	for i, r := range records {
+		putFileRecordHeader(pdu.Data[1+7*i:], r.File, r.Record, r.Length)
+	}
+	return
+}
+
+func WriteFileRecord(slaveId byte, records []FileRecord) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeWriteFileRecord}
+	pdu.Data = []byte{0}
+
+	for _, r := range records {
+		sub := make([]byte, 7+2*len(r.Values))
+		putFileRecordHeader(sub, r.File, r.Record, uint16(len(r.Values)))
+		for i, v := range r.Values {
+			binary.BigEndian.PutUint16(sub[7+2*i:], v)
+		}
+		pdu.Data = append(pdu.Data, sub...)
+	}
+	pdu.Data[0] = byte(len(pdu.Data) - 1)
+	return
+}
+
+func putFileRecordHeader(b []byte, file uint16, record uint16, length uint16) {
+	b[0] = FileRecordRefType
+	binary.BigEndian.PutUint16(b[1:], file)
+	binary.BigEndian.PutUint16(b[3:], record)
+	binary.BigEndian.PutUint16(b[5:], length)
+}
+
+func ReadFIFOQueue(slaveId byte, addr uint16) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReadFIFOQueue}
+	pdu.Data = make([]byte, 2)
+	binary.BigEndian.PutUint16(pdu.Data, addr)
+	return
+}
+
+func ReadWriteMultipleRegisters(slaveId byte, readAddr uint16, readCount uint16, writeAddr uint16, values []uint16) (pdu *ProtocolDataUnit) {
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReadWriteMultipleRegisters}
+	pdu.Data = make([]byte, 9+2*len(values))
+	binary.BigEndian.PutUint16(pdu.Data, readAddr)
+	binary.BigEndian.PutUint16(pdu.Data[2:], readCount)
+	binary.BigEndian.PutUint16(pdu.Data[4:], writeAddr)
+	binary.BigEndian.PutUint16(pdu.Data[6:], uint16(len(values)))
+	pdu.Data[8] = byte(2 * len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(pdu.Data[9+2*i:], v)
+	}
+
+	return
+}
+
+// IsWriteFunction returns true for functions that only write data, so they can be broadcast.
+func IsWriteFunction(fn byte) bool {
+	switch fn {
+	case FuncCodeWriteSingleCoil, FuncCodeWriteSingleRegister, FuncCodeWriteMultipleCoils,
+		FuncCodeWriteMultipleRegisters, FuncCodeWriteFileRecord, FuncCodeMaskWriteRegister:
+		return true
+	default:
+		return false
+	}
+}
+
+// ModifiesState returns true for requests that change the slave state, they are not safe to send twice.
+// Besides writes these are read/write multiple registers and diagnostic restart, listen only and clear sub-functions.
+func ModifiesState(pdu *ProtocolDataUnit) bool {
+	switch pdu.FunctionCode {
+	case FuncCodeReadWriteMultipleRegisters:
+		return true
+	case FuncCodeDiagnostic:
+		sub, _, err := DecodeDiagnostic(pdu)
+		if err != nil {
+			return true
+		}
+
+		switch sub {
+		case DiagRestartCommunications, DiagForceListenOnly, DiagClearCounters, DiagClearOverrunCounter:
+			return true
+		}
+		return false
+	default:
+		return IsWriteFunction(pdu.FunctionCode)
+	}
+}
+
+// WriteResponse makes normal response to the write request, as the device would answer it.
+func WriteResponse(req *ProtocolDataUnit) *ProtocolDataUnit {
+	pdu := &ProtocolDataUnit{SlaveId: req.SlaveId, FunctionCode: req.FunctionCode}
+
+	switch req.FunctionCode {
+	case FuncCodeWriteMultipleCoils, FuncCodeWriteMultipleRegisters:
+		// address and quantity
+		pdu.Data = append([]byte{}, req.Data[:4]...)
+	default:
+		// echo
+		pdu.Data = append([]byte{}, req.Data...)
+	}
+	return pdu
+}
+
+// ValidateResponse checks that ans is the answer to req: slave id, function, data length
+// for reads and address/value echo for writes.
+func ValidateResponse(req *ProtocolDataUnit, ans *ProtocolDataUnit) error {
+	if ans.SlaveId != req.SlaveId {
+		return fmt.Errorf("%w: sent to %d, got from %d", ErrBadSlaveId, req.SlaveId, ans.SlaveId)
+	}
+
+	if ans.FunctionCode == req.FunctionCode|0x80 {
+		if len(ans.Data) != 1 {
+			return fmt.Errorf("%w: exception data length %d", ErrBadLength, len(ans.Data))
+		}
+		return nil
+	}
+
+	if ans.FunctionCode != req.FunctionCode {
+		return fmt.Errorf("%w: sent fn %d, got fn %d", ErrBadFunction, req.FunctionCode, ans.FunctionCode)
+	}
+
+	if IsWriteFunction(req.FunctionCode) {
+		if !bytes.Equal(ans.Data, WriteResponse(req).Data) {
+			return fmt.Errorf("%w: fn %d answer %x", ErrBadWriteEcho, ans.FunctionCode, ans.Data)
+		}
+		return nil
+	}
+
+	if len(req.Data) < 4 {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint16(req.Data[2:]))
+	var l int
+
+	switch req.FunctionCode {
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs:
+		l = 1 + (count+7)/8
+	case FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters, FuncCodeReadWriteMultipleRegisters:
+		l = 1 + count*2
+	default:
+		return nil
+	}
+
+	if len(ans.Data) != l || int(ans.Data[0]) != l-1 {
+		return fmt.Errorf("%w: fn %d answer length %d, expected %d", ErrBadLength, ans.FunctionCode, len(ans.Data), l)
+	}
+	return nil
+}
+
 func NewModbusError(pdu *ProtocolDataUnit, errorCode byte) (e *ProtocolDataUnit) {
 	e = &ProtocolDataUnit{}
 	e.SlaveId = pdu.SlaveId
@@ -246,13 +453,17 @@ func (pdu *ProtocolDataUnit) MakeRtu() (adu []byte, err error) {
 
 func FromRtu(adu []byte) (pdu *ProtocolDataUnit, err error) {
 	length := len(adu)
+	if length < RtuMinSize {
+		err = fmt.Errorf("%w: rtu frame length %d", ErrShortFrame, length)
+		return
+	}
 	// Calculate checksum
 	var crc crc
 	crc.reset().pushBytes(adu[0 : length-2])
 	checksum := uint16(adu[length-1])<<8 | uint16(adu[length-2])
 
 	if checksum != crc.value() {
-		err = fmt.Errorf("modbus: response crc '%v' does not match expected '%v'", checksum, crc.value())
+		err = fmt.Errorf("%w: response crc '%v' does not match expected '%v'", ErrCRCMismatch, checksum, crc.value())
 		return
 	}
 
@@ -261,6 +472,67 @@ func FromRtu(adu []byte) (pdu *ProtocolDataUnit, err error) {
 	pdu.SlaveId = adu[0]
 	pdu.FunctionCode = adu[1]
 	pdu.Data = adu[2 : length-2]
+
+	err = checkPayload(pdu.FunctionCode, pdu.Data)
+	return
+}
+
+func (pdu *ProtocolDataUnit) MakeAscii() (adu []byte, err error) {
+	length := len(pdu.Data) + 3
+	if length > RtuMaxSize-1 {
+		err = fmt.Errorf("modbus: length of data '%v' must not be bigger than '%v'", length, RtuMaxSize-1)
+		return
+	}
+	raw := make([]byte, length)
+
+	raw[0] = pdu.SlaveId
+	raw[1] = pdu.FunctionCode
+	copy(raw[2:], pdu.Data)
+
+	var lrc lrc
+	raw[length-1] = lrc.reset().pushBytes(raw[:length-1]).value()
+
+	adu = []byte(":" + strings.ToUpper(hex.EncodeToString(raw)) + "\r\n")
+	return
+}
+
+func FromAscii(adu []byte) (pdu *ProtocolDataUnit, err error) {
+	length := len(adu)
+	if length < AsciiMinSize {
+		err = fmt.Errorf("%w: ascii frame length %d", ErrShortFrame, length)
+		return
+	}
+
+	if adu[0] != ':' || adu[length-2] != '\r' || adu[length-1] != '\n' {
+		err = fmt.Errorf("%w: no ascii frame start or end", ErrBadPayload)
+		return
+	}
+
+	if (length-3)%2 != 0 {
+		err = fmt.Errorf("%w: odd number of ascii chars %d", ErrBadLength, length-3)
+		return
+	}
+
+	raw := make([]byte, (length-3)/2)
+	if _, err = hex.Decode(raw, adu[1:length-2]); err != nil {
+		err = fmt.Errorf("%w: %s", ErrBadPayload, err.Error())
+		return
+	}
+
+	var lrc lrc
+	lrc.reset().pushBytes(raw[:len(raw)-1])
+
+	if raw[len(raw)-1] != lrc.value() {
+		err = fmt.Errorf("%w: response lrc '%v' does not match expected '%v'", ErrLRCMismatch, raw[len(raw)-1], lrc.value())
+		return
+	}
+
+	pdu = &ProtocolDataUnit{}
+	pdu.SlaveId = raw[0]
+	pdu.FunctionCode = raw[1]
+	pdu.Data = raw[2 : len(raw)-1]
+
+	err = checkPayload(pdu.FunctionCode, pdu.Data)
 	return
 }
 
@@ -280,14 +552,27 @@ func (pdu *ProtocolDataUnit) MakeTCP(transactionId uint16) (adu []byte) {
 	return
 }
 
+// FromTCP parses modbus tcp request adu. If the frame itself is correct, but the payload is malformed,
+// both pdu and ErrBadPayload are returned, so the caller can answer with an exception.
 func FromTCP(adu []byte) (transactionId uint16, pdu *ProtocolDataUnit, err error) {
+	if len(adu) < TcpHeaderSize+1 {
+		err = fmt.Errorf("%w: tcp frame length %d", ErrShortFrame, len(adu))
+		return
+	}
+
 	transactionId = binary.BigEndian.Uint16(adu)
-	// readManyPDU length value in the header
+
+	if protocolId := binary.BigEndian.Uint16(adu[2:]); protocolId != 0 {
+		err = fmt.Errorf("%w: %d", ErrBadProtocolID, protocolId)
+		return
+	}
+
+	// length value in the header
 	length := binary.BigEndian.Uint16(adu[4:])
 	pduLength := len(adu) - TcpHeaderSize
 
-	if pduLength <= 0 || pduLength != int(length-1) {
-		err = fmt.Errorf("modbus: length in response '%v' does not match pdu data length '%v'", length-1, pduLength)
+	if length < 2 || int(length) > TcpMaxLength-TcpHeaderSize+1 || pduLength != int(length-1) {
+		err = fmt.Errorf("%w: length in header '%v' does not match pdu length '%v'", ErrBadLength, length, pduLength)
 		return
 	}
 
@@ -296,9 +581,116 @@ func FromTCP(adu []byte) (transactionId uint16, pdu *ProtocolDataUnit, err error
 	// The first byte after header is function code
 	pdu.FunctionCode = adu[TcpHeaderSize]
 	pdu.Data = adu[TcpHeaderSize+1:]
+
+	err = checkRequest(pdu.FunctionCode, pdu.Data)
 	return
 }
 
+// FromTCPResponse parses modbus tcp response, as FromTCP does for requests.
+func FromTCPResponse(adu []byte) (transactionId uint16, pdu *ProtocolDataUnit, err error) {
+	transactionId, pdu, err = FromTCP(adu)
+	if pdu == nil || (err != nil && !errors.Is(err, ErrBadPayload)) {
+		return
+	}
+
+	err = checkResponse(pdu.FunctionCode, pdu.Data)
+	return
+}
+
+// checkPayload checks that data has a valid shape for the function code,
+// either as a request or as a response. Rtu and ascii frames are decoded on both sides of the bus.
+func checkPayload(fn byte, data []byte) error {
+	if checkRequest(fn, data) == nil {
+		return nil
+	}
+	return checkResponse(fn, data)
+}
+
+// checkRequest checks that data has a valid shape and quantities of the request for the function code.
+func checkRequest(fn byte, data []byte) error {
+	l := len(data)
+	ok := true
+
+	switch {
+	case fn&0x80 != 0:
+		ok = false
+	case fn == FuncCodeReadCoils, fn == FuncCodeReadDiscreteInputs:
+		ok = l == 4 && quantityValid(data[2:], 2000)
+	case fn == FuncCodeReadHoldingRegisters, fn == FuncCodeReadInputRegisters:
+		ok = l == 4 && quantityValid(data[2:], 125)
+	case fn == FuncCodeWriteSingleCoil, fn == FuncCodeWriteSingleRegister:
+		ok = l == 4
+	case fn == FuncCodeWriteMultipleCoils:
+		ok = l > 4 && l == 5+int(data[4]) && quantityValid(data[2:], 1968) &&
+			int(data[4]) == (int(binary.BigEndian.Uint16(data[2:]))+7)/8
+	case fn == FuncCodeWriteMultipleRegisters:
+		ok = l > 4 && l == 5+int(data[4]) && quantityValid(data[2:], 123) &&
+			int(data[4]) == 2*int(binary.BigEndian.Uint16(data[2:]))
+	case fn == FuncCodeMaskWriteRegister:
+		ok = l == 6
+	case fn == FuncCodeReadWriteMultipleRegisters:
+		// read address, read quantity, write address, write quantity, byte count
+		ok = l > 8 && l == 9+int(data[8]) && quantityValid(data[2:], 125) && quantityValid(data[6:], 121) &&
+			int(data[8]) == 2*int(binary.BigEndian.Uint16(data[6:]))
+	case fn == FuncCodeReadFileRecord, fn == FuncCodeWriteFileRecord:
+		ok = l > 0 && l == 1+int(data[0])
+	case fn == FuncCodeDiagnostic:
+		ok = l >= 2
+	case fn == FuncCodeReadExceptionStatus, fn == FuncCodeGetComEventCounter,
+		fn == FuncCodeGetComEventLog, fn == FuncCodeReportSlaveId:
+		ok = l == 0
+	case fn == FuncCodeEncapsulatedInterfaceTransport:
+		ok = l > 0
+	case fn == FuncCodeReadFIFOQueue:
+		ok = l == 2
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: fn %#.2x, request data length %d", ErrBadPayload, fn, l)
+	}
+	return nil
+}
+
+// checkResponse checks that data has a valid shape of the response for the function code.
+func checkResponse(fn byte, data []byte) error {
+	l := len(data)
+	ok := true
+
+	switch {
+	case fn&0x80 != 0:
+		ok = l == 1
+	case fn == FuncCodeReadCoils, fn == FuncCodeReadDiscreteInputs,
+		fn == FuncCodeReadHoldingRegisters, fn == FuncCodeReadInputRegisters,
+		fn == FuncCodeReadWriteMultipleRegisters, fn == FuncCodeReadFileRecord, fn == FuncCodeWriteFileRecord,
+		fn == FuncCodeGetComEventLog, fn == FuncCodeReportSlaveId:
+		ok = l > 0 && l == 1+int(data[0])
+	case fn == FuncCodeWriteSingleCoil, fn == FuncCodeWriteSingleRegister,
+		fn == FuncCodeWriteMultipleCoils, fn == FuncCodeWriteMultipleRegisters, fn == FuncCodeGetComEventCounter:
+		ok = l == 4
+	case fn == FuncCodeMaskWriteRegister:
+		ok = l == 6
+	case fn == FuncCodeDiagnostic:
+		ok = l >= 2
+	case fn == FuncCodeReadExceptionStatus:
+		ok = l == 1
+	case fn == FuncCodeEncapsulatedInterfaceTransport:
+		ok = l > 0
+	case fn == FuncCodeReadFIFOQueue:
+		ok = l > 1 && l == 2+int(binary.BigEndian.Uint16(data))
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: fn %#.2x, response data length %d", ErrBadPayload, fn, l)
+	}
+	return nil
+}
+
+// quantityValid checks that quantity at the start of data is 1..max.
+func quantityValid(data []byte, max int) bool {
+	q := int(binary.BigEndian.Uint16(data))
+	return q >= 1 && q <= max
+}
+
 func DecodeCoils(pdu *ProtocolDataUnit) ([]bool, error) {
 	var i byte
 
@@ -306,6 +698,10 @@ func DecodeCoils(pdu *ProtocolDataUnit) ([]bool, error) {
 		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
 	}
 
+	if len(pdu.Data) == 0 || len(pdu.Data) < 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
 	size := pdu.Data[0] * 8
 	res := make([]bool, size)
 
@@ -319,10 +715,15 @@ func DecodeCoils(pdu *ProtocolDataUnit) ([]bool, error) {
 func DecodeValues(pdu *ProtocolDataUnit) ([]uint16, error) {
 	var i byte
 
-	if pdu.FunctionCode != FuncCodeReadInputRegisters && pdu.FunctionCode != FuncCodeReadHoldingRegisters {
+	if pdu.FunctionCode != FuncCodeReadInputRegisters && pdu.FunctionCode != FuncCodeReadHoldingRegisters &&
+		pdu.FunctionCode != FuncCodeReadWriteMultipleRegisters {
 		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
 	}
 
+	if len(pdu.Data) == 0 || len(pdu.Data) < 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
 	size := pdu.Data[0] / 2
 	res := make([]uint16, size)
 
@@ -332,3 +733,162 @@ func DecodeValues(pdu *ProtocolDataUnit) ([]uint16, error) {
 
 	return res, nil
 }
+
+// DecodeFIFOQueue returns values from read fifo queue response.
+func DecodeFIFOQueue(pdu *ProtocolDataUnit) ([]uint16, error) {
+	if pdu.FunctionCode != FuncCodeReadFIFOQueue {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) < 4 {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	byteCount := int(binary.BigEndian.Uint16(pdu.Data))
+	count := int(binary.BigEndian.Uint16(pdu.Data[2:]))
+
+	if count > MaxFIFOCount || byteCount != 2+2*count || len(pdu.Data) != 2+byteCount {
+		return nil, fmt.Errorf("%w: byte count %d, fifo count %d, data length %d", ErrBadPayload, byteCount, count, len(pdu.Data))
+	}
+
+	res := make([]uint16, count)
+	for i := range res {
+		res[i] = binary.BigEndian.Uint16(pdu.Data[4+2*i:])
+	}
+
+	return res, nil
+}
+
+// DecodeFileRecords returns sub-requests from read file record request
+// or from write file record request or response (with values).
+func DecodeFileRecords(pdu *ProtocolDataUnit) ([]FileRecord, error) {
+	if pdu.FunctionCode != FuncCodeReadFileRecord && pdu.FunctionCode != FuncCodeWriteFileRecord {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) == 0 || len(pdu.Data) != 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	var res []FileRecord
+	data := pdu.Data[1:]
+
+	for len(data) > 0 {
+		if len(data) < 7 || data[0] != FileRecordRefType {
+			return nil, fmt.Errorf("%w: bad file sub-request", ErrBadPayload)
+		}
+
+		r := FileRecord{
+			File:   binary.BigEndian.Uint16(data[1:]),
+			Record: binary.BigEndian.Uint16(data[3:]),
+			Length: binary.BigEndian.Uint16(data[5:]),
+		}
+		data = data[7:]
+
+		if pdu.FunctionCode == FuncCodeWriteFileRecord {
+			if len(data) < 2*int(r.Length) {
+				return nil, fmt.Errorf("%w: file sub-request data is too short", ErrBadPayload)
+			}
+			r.Values = make([]uint16, r.Length)
+			for i := range r.Values {
+				r.Values[i] = binary.BigEndian.Uint16(data[2*i:])
+			}
+			data = data[2*r.Length:]
+		}
+
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+// DecodeReadFileRecord returns values for every sub-request from read file record response.
+func DecodeReadFileRecord(pdu *ProtocolDataUnit) ([][]uint16, error) {
+	if pdu.FunctionCode != FuncCodeReadFileRecord {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) == 0 || len(pdu.Data) != 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	var res [][]uint16
+	data := pdu.Data[1:]
+
+	for len(data) > 0 {
+		l := int(data[0])
+		if l < 1 || l%2 != 1 || len(data) < 1+l || data[1] != FileRecordRefType {
+			return nil, fmt.Errorf("%w: bad file sub-response", ErrBadPayload)
+		}
+
+		vals := make([]uint16, (l-1)/2)
+		for i := range vals {
+			vals[i] = binary.BigEndian.Uint16(data[2+2*i:])
+		}
+		res = append(res, vals)
+		data = data[1+l:]
+	}
+
+	return res, nil
+}
+
+// ReadFileRecordResponseSize returns pdu size of the read file record response to the sub-requests.
+func ReadFileRecordResponseSize(records []FileRecord) int {
+	// function code and byte count
+	n := 2
+	for _, r := range records {
+		n += 2 + 2*int(r.Length)
+	}
+	return n
+}
+
+// MakeReadFileRecordResponse makes read file record response from values for every sub-request.
+// Error is returned if the response is bigger than PduMaxSize.
+func MakeReadFileRecordResponse(slaveId byte, values [][]uint16) (pdu *ProtocolDataUnit, err error) {
+	size := 2
+	for _, vals := range values {
+		size += 2 + 2*len(vals)
+	}
+
+	if size > PduMaxSize {
+		return nil, fmt.Errorf("%w: response size %d", ErrBadPayload, size)
+	}
+
+	pdu = &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReadFileRecord}
+	pdu.Data = []byte{0}
+
+	for _, vals := range values {
+		sub := make([]byte, 2+2*len(vals))
+		sub[0] = byte(1 + 2*len(vals))
+		sub[1] = FileRecordRefType
+		for i, v := range vals {
+			binary.BigEndian.PutUint16(sub[2+2*i:], v)
+		}
+		pdu.Data = append(pdu.Data, sub...)
+	}
+	pdu.Data[0] = byte(len(pdu.Data) - 1)
+	return
+}
+
+// DecodeMaskWrite returns address and masks from mask write request or its echoed response.
+func DecodeMaskWrite(pdu *ProtocolDataUnit) (addr uint16, andMask uint16, orMask uint16, err error) {
+	if pdu.FunctionCode != FuncCodeMaskWriteRegister {
+		err = fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+		return
+	}
+
+	if len(pdu.Data) != 6 {
+		err = fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+		return
+	}
+
+	addr = binary.BigEndian.Uint16(pdu.Data)
+	andMask = binary.BigEndian.Uint16(pdu.Data[2:])
+	orMask = binary.BigEndian.Uint16(pdu.Data[4:])
+	return
+}
+
+// MaskValue applies mask write masks to the register value.
+func MaskValue(val uint16, andMask uint16, orMask uint16) uint16 {
+	return (val & andMask) | (orMask &^ andMask)
+}
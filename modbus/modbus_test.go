@@ -1,6 +1,8 @@
 package modbus
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -38,3 +40,231 @@ func TestFromRtuInvalidCRC(t *testing.T) {
 		t.Fatalf("invalid crc passed")
 	}
 }
+
+func TestFromRtuShort(t *testing.T) {
+	if _, err := FromRtu([]byte{0x1}); !errors.Is(err, ErrShortFrame) {
+		t.Fatalf("expected ErrShortFrame, got %v", err)
+	}
+
+	if _, err := FromRtu([]byte{0x2, 0xf, 0, 0x13, 0, 0xa, 0x2, 0xcd, 0x1, 0x72, 0xcb}); !errors.Is(err, ErrCRCMismatch) {
+		t.Fatalf("expected ErrCRCMismatch, got %v", err)
+	}
+}
+
+func TestFromTCPErrors(t *testing.T) {
+	if _, _, err := FromTCP([]byte{0, 1, 0}); !errors.Is(err, ErrShortFrame) {
+		t.Errorf("expected ErrShortFrame, got %v", err)
+	}
+
+	if _, _, err := FromTCP([]byte{0, 1, 0, 1, 0, 6, 1, 3, 0, 0, 0, 1}); !errors.Is(err, ErrBadProtocolID) {
+		t.Errorf("expected ErrBadProtocolID, got %v", err)
+	}
+
+	if _, _, err := FromTCP([]byte{0, 1, 0, 0, 0, 8, 1, 3, 0, 0, 0, 1}); !errors.Is(err, ErrBadLength) {
+		t.Errorf("expected ErrBadLength, got %v", err)
+	}
+
+	trId, pdu, err := FromTCP([]byte{0, 1, 0, 0, 0, 5, 1, 3, 0, 0, 0})
+	if !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+	if pdu == nil || pdu.FunctionCode != 3 || trId != 1 {
+		t.Errorf("expected pdu with bad payload, got %v", pdu)
+	}
+
+	trId, pdu, err = FromTCP(ReadHoldingRegisters(1, 2, 3).MakeTCP(10))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if trId != 10 || pdu.SlaveId != 1 || pdu.FunctionCode != FuncCodeReadHoldingRegisters {
+		t.Errorf("bad pdu %v", pdu)
+	}
+}
+
+func TestAscii(t *testing.T) {
+	adu, err := ReadHoldingRegisters(1, 1, 1).MakeAscii()
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if string(adu) != ":010300010001FA\r\n" {
+		t.Fatalf("got %q", adu)
+	}
+
+	pdu, err := FromAscii([]byte(":0103020102F7\r\n"))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if pdu.SlaveId != 1 || pdu.FunctionCode != 3 || !bytes.Equal(pdu.Data, []byte{2, 1, 2}) {
+		t.Fatalf("bad pdu %v", pdu)
+	}
+
+	if _, err := FromAscii([]byte(":0103020102F8\r\n")); !errors.Is(err, ErrLRCMismatch) {
+		t.Fatalf("expected ErrLRCMismatch, got %v", err)
+	}
+
+	if _, err := FromAscii([]byte(":01\r\n")); !errors.Is(err, ErrShortFrame) {
+		t.Fatalf("expected ErrShortFrame, got %v", err)
+	}
+}
+
+func TestReadWriteResponseLength(t *testing.T) {
+	adu, _ := ReadWriteMultipleRegisters(1, 0, 3, 10, []uint16{1, 2, 3, 4, 5}).MakeRtu()
+
+	if l := calculateResponseLength(adu); l != RtuMinSize+1+6 {
+		t.Errorf("expected length %d, got %d", RtuMinSize+1+6, l)
+	}
+}
+
+func TestDecodeFIFOQueue(t *testing.T) {
+	pdu := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadFIFOQueue, Data: []byte{0, 6, 0, 2, 0x01, 0xb8, 0x12, 0x84}}
+
+	res, err := DecodeFIFOQueue(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if len(res) != 2 || res[0] != 0x1b8 || res[1] != 0x1284 {
+		t.Errorf("wrong values %v", res)
+	}
+
+	pdu.Data = []byte{0, 6, 0, 3, 0x01, 0xb8, 0x12, 0x84}
+	if _, err := DecodeFIFOQueue(pdu); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+}
+
+func TestReadFileRecord(t *testing.T) {
+	pdu := ReadFileRecord(1, []FileRecord{{File: 4, Record: 1, Length: 2}, {File: 3, Record: 9, Length: 2}})
+
+	expected := []byte{0x0e, 6, 0, 4, 0, 1, 0, 2, 6, 0, 3, 0, 9, 0, 2}
+	if !bytes.Equal(pdu.Data, expected) {
+		t.Fatalf("got %x, expected %x", pdu.Data, expected)
+	}
+
+	ans := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadFileRecord,
+		Data: []byte{0x0c, 5, 6, 0x0d, 0xfe, 0, 0x20, 5, 6, 0x33, 0xcd, 0, 0x40}}
+
+	res, err := DecodeReadFileRecord(ans)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if len(res) != 2 || res[0][0] != 0x0dfe || res[0][1] != 0x20 || res[1][0] != 0x33cd || res[1][1] != 0x40 {
+		t.Errorf("wrong values %v", res)
+	}
+}
+
+func TestReadFileRecordResponseSize(t *testing.T) {
+	if _, err := MakeReadFileRecordResponse(1, [][]uint16{make([]uint16, 124)}); err != nil {
+		t.Errorf("error %v", err)
+	}
+
+	if n := ReadFileRecordResponseSize([]FileRecord{{Length: 124}}); n != 252 {
+		t.Errorf("got size %d, expected 252", n)
+	}
+
+	// byte count would wrap
+	if _, err := MakeReadFileRecordResponse(1, [][]uint16{make([]uint16, 125)}); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	read := ReadCoils(1, 0, 10)
+	write := WriteSingleRegister(1, 5, 0x1234)
+
+	tests := []struct {
+		req *ProtocolDataUnit
+		ans *ProtocolDataUnit
+		err error
+	}{
+		{read, &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadCoils, Data: []byte{2, 0xff, 3}}, nil},
+		{read, &ProtocolDataUnit{SlaveId: 2, FunctionCode: FuncCodeReadCoils, Data: []byte{2, 0xff, 3}}, ErrBadSlaveId},
+		{read, &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadDiscreteInputs, Data: []byte{2, 0xff, 3}}, ErrBadFunction},
+		{read, &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadCoils, Data: []byte{1, 0xff}}, ErrBadLength},
+		{read, NewModbusError(read, ExceptionCodeIllegalDataAddress), nil},
+		{write, WriteResponse(write), nil},
+		{write, WriteSingleRegister(1, 5, 0x1235), ErrBadWriteEcho},
+		{write, WriteSingleRegister(1, 6, 0x1234), ErrBadWriteEcho},
+	}
+
+	for i, tt := range tests {
+		if err := ValidateResponse(tt.req, tt.ans); !errors.Is(err, tt.err) {
+			t.Errorf("%d: expected %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestFromTCPRequestShape(t *testing.T) {
+	// 1 byte read request looks like an empty read response
+	if _, pdu, err := FromTCP([]byte{0, 1, 0, 0, 0, 3, 100, 3, 0}); !errors.Is(err, ErrBadPayload) || pdu == nil {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+
+	// write multiple registers request looks like the write answer
+	if _, _, err := FromTCP([]byte{0, 1, 0, 0, 0, 6, 100, 16, 0, 0, 0, 5}); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+
+	// byte count does not match quantity
+	if _, _, err := FromTCP([]byte{0, 1, 0, 0, 0, 9, 100, 16, 0, 0, 0, 1, 2, 0, 1}); err != nil {
+		t.Errorf("error %v", err)
+	}
+	if _, _, err := FromTCP([]byte{0, 1, 0, 0, 0, 9, 100, 16, 0, 0, 0, 2, 2, 0, 1}); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+
+	// read write multiple registers, write quantity 1 with 4 bytes
+	if _, _, err := FromTCP(append([]byte{0, 1, 0, 0, 0, 15, 100, 23, 0, 0, 0, 1, 0, 0, 0, 1, 4}, 0, 1, 0, 2)); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+
+	if _, _, err := FromTCP(ReadWriteMultipleRegisters(1, 0, 2, 0, []uint16{1, 2}).MakeTCP(1)); err != nil {
+		t.Errorf("error %v", err)
+	}
+
+	// too many registers
+	if _, _, err := FromTCP(ReadHoldingRegisters(1, 0, 126).MakeTCP(1)); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("expected ErrBadPayload, got %v", err)
+	}
+}
+
+func TestFromTCPResponse(t *testing.T) {
+	ans := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0, 1}}
+
+	if _, _, err := FromTCPResponse(ans.MakeTCP(1)); err != nil {
+		t.Errorf("error %v", err)
+	}
+
+	if _, _, err := FromTCP(ans.MakeTCP(1)); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("response must not pass as a request, got %v", err)
+	}
+
+	if _, _, err := FromTCPResponse(ReadHoldingRegisters(1, 0, 1).MakeTCP(1)); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("request must not pass as a response, got %v", err)
+	}
+}
+
+func TestModifiesState(t *testing.T) {
+	tests := []struct {
+		pdu      *ProtocolDataUnit
+		modifies bool
+	}{
+		{ReadHoldingRegisters(1, 0, 1), false},
+		{WriteSingleRegister(1, 0, 1), true},
+		{ReadWriteMultipleRegisters(1, 0, 1, 0, []uint16{1}), true},
+		{RestartCommunications(1, false), true},
+		{ForceListenOnly(1), true},
+		{DiagnosticCounter(1, DiagClearCounters), true},
+		{DiagnosticCounter(1, DiagReturnBusMessageCount), false},
+		{ReturnQueryData(1, []byte{1, 2}), false},
+	}
+
+	for _, tt := range tests {
+		if res := ModifiesState(tt.pdu); res != tt.modifies {
+			t.Errorf("%v: expected %v, got %v", tt.pdu, tt.modifies, res)
+		}
+	}
+}
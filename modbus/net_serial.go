@@ -0,0 +1,35 @@
+package modbus
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// NewNetSerial makes serial port attached to the network, e.g. ethernet to rs485 converter in raw (transparent) mode.
+// Baud rate of the bus is used for timings.
+func NewNetSerial(addr string, baudrate int) (s *SerialPort) {
+	s = NewSerial(addr, baudrate, 8, "N", 1)
+	s.open = func() (io.ReadWriteCloser, error) {
+		conn, err := net.DialTimeout("tcp", addr, s.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		// read timeout is the frame gap, as for serial port
+		return &deadlineConn{Conn: conn, timeout: s.frameGap()}, nil
+	}
+	return
+}
+
+// deadlineConn sets read deadline before every read, like serial port driver read timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
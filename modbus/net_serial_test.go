@@ -0,0 +1,145 @@
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// rtuServer is ethernet to rs485 converter stand-in, it answers read holding registers with register values
+// equal to the address. Connections are closed after closeAfter requests, if it is not 0.
+type rtuServer struct {
+	listener   net.Listener
+	telnet     bool
+	closeAfter int
+}
+
+func newRtuServer(t *testing.T, telnet bool) *rtuServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &rtuServer{listener: l, telnet: telnet}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *rtuServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *rtuServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *rtuServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var c net.Conn = conn
+	if s.telnet {
+		c = &telnetConn{Conn: conn}
+		// com port option answer, it must not get into the data
+		conn.Write([]byte{telnetIAC, telnetDO, telnetOptComPort, telnetIAC, telnetSB, telnetOptComPort, 101, 0, 0, 0x4b, 0, telnetIAC, telnetSE})
+	}
+
+	var data []byte
+	buf := make([]byte, RtuMaxSize)
+	requests := 0
+
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		data = append(data, buf[:n]...)
+
+		req, err := FromRtu(data)
+		if err != nil {
+			continue
+		}
+		data = nil
+
+		ans := &ProtocolDataUnit{SlaveId: req.SlaveId, FunctionCode: req.FunctionCode, Data: []byte{2, req.Data[0], req.Data[1]}}
+		adu, _ := ans.MakeRtu()
+		if _, err := c.Write(adu); err != nil {
+			return
+		}
+
+		requests++
+		if requests == s.closeAfter {
+			return
+		}
+	}
+}
+
+func TestRtuOverTcpClient(t *testing.T) {
+	srv := newRtuServer(t, false)
+	srv.closeAfter = 1
+
+	c := NewRtuOverTcpClient(srv.addr(), 115200)
+	defer c.Close()
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("connect error %v", err)
+	}
+
+	vals, err := c.ReadHoldingRegisters(1, 0x12ff, 1)
+	if err != nil || vals[0] != 0x12ff {
+		t.Fatalf("got %v, %v", vals, err)
+	}
+
+	// the server has closed the connection
+	if _, err := c.ReadHoldingRegisters(1, 5, 1); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// reconnect
+	vals, err = c.ReadHoldingRegisters(1, 5, 1)
+	if err != nil || vals[0] != 5 {
+		t.Fatalf("got %v, %v after reconnect", vals, err)
+	}
+}
+
+func TestRfc2217(t *testing.T) {
+	srv := newRtuServer(t, true)
+
+	sp := NewRfc2217Serial(srv.addr(), 115200, 8, "N", 1)
+	sp.IdleTimeout = 0
+	defer sp.Close()
+
+	// 0xff in the request and answer must be escaped
+	req, _ := ReadHoldingRegisters(1, 0xffff, 1).MakeRtu()
+	res, err := sp.Send(req)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	ans, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0xff, 0xff}}).MakeRtu()
+	if !bytes.Equal(res, ans) {
+		t.Errorf("got %x, expected %x", res, ans)
+	}
+}
+
+func TestTelnetParse(t *testing.T) {
+	c := &telnetConn{}
+
+	// IAC IAC is data, WILL ECHO is refused, subnegotiation is skipped, command can be split
+	res, reply := c.parse([]byte{1, telnetIAC, telnetIAC, 2, telnetIAC, telnetWILL, 1, telnetIAC, telnetSB, 44, telnetIAC}, nil)
+	res2, _ := c.parse([]byte{telnetSE, 3}, res)
+
+	if !bytes.Equal(res2, []byte{1, telnetIAC, 2, 3}) {
+		t.Errorf("wrong data %x", res2)
+	}
+
+	if !bytes.Equal(reply, []byte{telnetIAC, telnetDONT, 1}) {
+		t.Errorf("wrong reply %x", reply)
+	}
+}
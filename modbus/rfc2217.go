@@ -0,0 +1,209 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// telnet commands and options, see RFC 854, RFC 856, RFC 858 and RFC 2217
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary  = 0
+	telnetOptSGA     = 3
+	telnetOptComPort = 44
+
+	comPortSetBaudrate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortSetControl  = 5
+
+	comPortParityNone = 1
+	comPortParityOdd  = 2
+	comPortParityEven = 3
+
+	comPortNoFlowControl = 1
+)
+
+// NewRfc2217Serial makes serial port of RFC 2217 (telnet com port control) server.
+// Line settings are sent to the server on every connect.
+func NewRfc2217Serial(addr string, baudrate int, data int, parity string, stop int) (s *SerialPort) {
+	s = NewSerial(addr, baudrate, data, parity, stop)
+	s.open = func() (io.ReadWriteCloser, error) {
+		conn, err := net.DialTimeout("tcp", addr, s.Timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := &telnetConn{Conn: conn}
+		if _, err := conn.Write(comPortSetup(s.BaudRate, s.DataBits, s.Parity, s.StopBits)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// read timeout is the frame gap, as for serial port
+		return &deadlineConn{Conn: tc, timeout: s.frameGap()}, nil
+	}
+	return
+}
+
+// comPortSetup makes options negotiation and line settings commands.
+func comPortSetup(baudrate int, data int, parity string, stop int) []byte {
+	b := []byte{
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptBinary,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptSGA,
+		telnetIAC, telnetWILL, telnetOptComPort,
+	}
+
+	var baud [4]byte
+	binary.BigEndian.PutUint32(baud[:], uint32(baudrate))
+	b = append(b, comPortCommand(comPortSetBaudrate, baud[:])...)
+	b = append(b, comPortCommand(comPortSetDataSize, []byte{byte(data)})...)
+
+	p := byte(comPortParityNone)
+	switch parity {
+	case "O":
+		p = comPortParityOdd
+	case "E":
+		p = comPortParityEven
+	}
+	b = append(b, comPortCommand(comPortSetParity, []byte{p})...)
+	b = append(b, comPortCommand(comPortSetStopSize, []byte{byte(stop)})...)
+	b = append(b, comPortCommand(comPortSetControl, []byte{comPortNoFlowControl})...)
+	return b
+}
+
+func comPortCommand(cmd byte, value []byte) []byte {
+	b := []byte{telnetIAC, telnetSB, telnetOptComPort, cmd}
+	b = append(b, telnetEscape(value)...)
+	return append(b, telnetIAC, telnetSE)
+}
+
+// telnetEscape doubles IAC bytes in the data.
+func telnetEscape(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+}
+
+// telnetConn escapes IAC in written data and removes telnet commands from the read data.
+// Options the server asks for are refused, except the negotiated ones.
+type telnetConn struct {
+	net.Conn
+	// parser state, command can be split between reads
+	state   byte
+	command byte
+	mutex   sync.Mutex
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+func (c *telnetConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(telnetEscape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *telnetConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	buf := make([]byte, len(b))
+	for {
+		n, err := c.Conn.Read(buf)
+		if n == 0 || err != nil {
+			return 0, err
+		}
+
+		res, reply := c.parse(buf[:n], b[:0])
+		if len(reply) > 0 {
+			if _, err := c.Conn.Write(reply); err != nil {
+				return 0, err
+			}
+		}
+
+		// only telnet commands were read
+		if len(res) > 0 {
+			return len(res), nil
+		}
+	}
+}
+
+// parse appends data from the stream to res, reply is the answer to the server option requests.
+func (c *telnetConn) parse(in []byte, res []byte) ([]byte, []byte) {
+	var reply []byte
+
+	for _, x := range in {
+		switch c.state {
+		case telnetStateData:
+			if x == telnetIAC {
+				c.state = telnetStateIAC
+			} else {
+				res = append(res, x)
+			}
+		case telnetStateIAC:
+			switch x {
+			case telnetIAC:
+				res = append(res, x)
+				c.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				c.command = x
+				c.state = telnetStateOption
+			case telnetSB:
+				c.state = telnetStateSB
+			default:
+				// commands without options, e.g. NOP
+				c.state = telnetStateData
+			}
+		case telnetStateOption:
+			reply = append(reply, telnetReply(c.command, x)...)
+			c.state = telnetStateData
+		case telnetStateSB:
+			// com port option answers are ignored
+			if x == telnetIAC {
+				c.state = telnetStateSBIAC
+			}
+		case telnetStateSBIAC:
+			if x == telnetSE {
+				c.state = telnetStateData
+			} else {
+				c.state = telnetStateSB
+			}
+		}
+	}
+
+	return res, reply
+}
+
+// telnetReply returns answer to option request, nil if the option is supported.
+func telnetReply(command byte, option byte) []byte {
+	switch option {
+	case telnetOptBinary, telnetOptSGA, telnetOptComPort:
+		return nil
+	}
+
+	switch command {
+	case telnetWILL:
+		return []byte{telnetIAC, telnetDONT, option}
+	case telnetDO:
+		return []byte{telnetIAC, telnetWONT, option}
+	default:
+		return nil
+	}
+}
@@ -1,8 +1,15 @@
 package modbus
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,16 +20,76 @@ import (
 const (
 	serialTimeout     = 500 * time.Millisecond
 	serialIdleTimeout = 60 * time.Second
+	// spec recommends 100 to 200 ms
+	serialTurnaroundDelay   = 100 * time.Millisecond
+	serialReconnectDelay    = 100 * time.Millisecond
+	serialMaxReconnectDelay = 10 * time.Second
 )
 
+// SerialStats are serial port counters.
+type SerialStats struct {
+	// EchoMismatches counts requests with wrong local echo, it means collision on the bus
+	EchoMismatches uint64
+	// StaleBytes counts bytes dropped from input before requests
+	StaleBytes uint64
+}
+
+type PortState int
+
+const (
+	PortClosed PortState = iota
+	PortOpen
+	// PortReconnecting is after i/o or open error, until the port is open again
+	PortReconnecting
+)
+
+func (s PortState) String() string {
+	switch s {
+	case PortOpen:
+		return "open"
+	case PortReconnecting:
+		return "reconnecting"
+	default:
+		return "closed"
+	}
+}
+
+// SerialStatus is the port state with the last error.
+type SerialStatus struct {
+	State         PortState
+	LastError     string
+	LastErrorTime time.Time
+}
+
 type SerialPort struct {
 	serial.Config
 
-	IdleTimeout  time.Duration
+	// open opens the underlying port, serial device by default
+	open func() (io.ReadWriteCloser, error)
+
+	Mode SerialMode
+	// EchoCancel is for rs485 adapters echoing sent bytes back, the echo is read and checked before the answer
+	EchoCancel  bool
+	IdleTimeout time.Duration
+	// ReconnectDelay is the pause after failed open, it is doubled up to MaxReconnectDelay for every next failure
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+	// TurnaroundDelay is the pause after broadcast request, so slaves can process it
+	TurnaroundDelay time.Duration
+	// mutex serializes transactions, idle close and Close, it guards fields below
+	mutex        sync.Mutex
 	port         io.ReadWriteCloser
 	lastActivity time.Time
-	closeTimer   *time.Timer
-	Logger       *zap.SugaredLogger
+	// no transactions until this time
+	quietUntil time.Time
+	closeTimer *time.Timer
+	// openDelay is the current pause between open attempts, no attempts until nextOpen
+	openDelay   time.Duration
+	nextOpen    time.Time
+	statusMutex sync.Mutex
+	status      SerialStatus
+	stats       SerialStats
+	Logger      *zap.SugaredLogger
 }
 
 func NewSerial(device string, baudrate int, data int, parity string, stop int) (s *SerialPort) {
@@ -32,26 +99,123 @@ func NewSerial(device string, baudrate int, data int, parity string, stop int) (
 	s.DataBits = data
 	s.Parity = parity
 	s.StopBits = stop
+	// Timeout is the answer timeout, driver read timeout is set to the frame gap
 	s.Timeout = serialTimeout
 	s.IdleTimeout = serialIdleTimeout
+	s.TurnaroundDelay = serialTurnaroundDelay
+	s.ReconnectDelay = serialReconnectDelay
+	s.Logger = zap.NewNop().Sugar()
+	s.MaxReconnectDelay = serialMaxReconnectDelay
+	s.open = func() (io.ReadWriteCloser, error) {
+		// driver read timeout is the frame gap, so silence on the line can be detected
+		c := s.Config
+		c.Timeout = s.frameGap()
+		return serial.Open(&c)
+	}
 	return
 }
 
+// Encode makes adu for the pdu in the port mode.
+func (sp *SerialPort) Encode(pdu *ProtocolDataUnit) ([]byte, error) {
+	return sp.Mode.Encode(pdu)
+}
+
+// Decode parses adu in the port mode.
+func (sp *SerialPort) Decode(adu []byte) (*ProtocolDataUnit, error) {
+	return sp.Mode.Decode(adu)
+}
+
+// Stats returns counters of the port.
+func (sp *SerialPort) Stats() SerialStats {
+	return SerialStats{
+		EchoMismatches: atomic.LoadUint64(&sp.stats.EchoMismatches),
+		StaleBytes:     atomic.LoadUint64(&sp.stats.StaleBytes),
+	}
+}
+
+func (sp *SerialPort) String() string {
+	return fmt.Sprintf("%s %d %d%s%d %s", sp.Address, sp.BaudRate, sp.DataBits, sp.Parity, sp.StopBits, sp.Mode)
+}
+
+// Close closes the port, it is reopened on the next request.
+// It waits for the current transaction to finish.
+func (sp *SerialPort) Close() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if sp.closeTimer != nil {
+		sp.closeTimer.Stop()
+	}
+	return sp.close()
+}
+
+// Connect opens the port, otherwise it is opened on the first request.
+func (sp *SerialPort) Connect() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	return sp.connect()
+}
+
+// connect opens the port if it is closed. Failed opens are retried with exponential backoff,
+// requests fail without trying to open the port until the next attempt time.
 func (sp *SerialPort) connect() error {
-	if sp.port == nil {
-		port, err := serial.Open(&sp.Config)
-		if err != nil {
-			return err
+	if sp.port != nil {
+		return nil
+	}
+
+	if wait := time.Until(sp.nextOpen); wait > 0 {
+		return fmt.Errorf("%w: next attempt in %v", ErrNotConnected, wait.Round(time.Millisecond))
+	}
+
+	port, err := sp.open()
+	if err != nil {
+		sp.openDelay *= 2
+		if sp.openDelay < sp.ReconnectDelay {
+			sp.openDelay = sp.ReconnectDelay
+		}
+		if sp.openDelay > sp.MaxReconnectDelay {
+			sp.openDelay = sp.MaxReconnectDelay
 		}
-		sp.port = port
+		sp.nextOpen = time.Now().Add(sp.openDelay)
+		sp.setState(PortReconnecting, err)
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
 	}
+
+	sp.port = port
+	sp.openDelay = 0
+	sp.setState(PortOpen, nil)
 	return nil
 }
 
+// setState sets port state, err is saved as the last error if it is not nil.
+func (sp *SerialPort) setState(state PortState, err error) {
+	sp.statusMutex.Lock()
+	defer sp.statusMutex.Unlock()
+
+	if sp.status.State != state {
+		sp.Logger.Infof("serial: port is %s", state)
+	}
+	sp.status.State = state
+	if err != nil {
+		sp.status.LastError = err.Error()
+		sp.status.LastErrorTime = time.Now()
+	}
+}
+
+// Status returns port state and the last error.
+func (sp *SerialPort) Status() SerialStatus {
+	sp.statusMutex.Lock()
+	defer sp.statusMutex.Unlock()
+
+	return sp.status
+}
+
 func (sp *SerialPort) close() (err error) {
 	if sp.port != nil {
 		err = sp.port.Close()
 		sp.port = nil
+		sp.setState(PortClosed, nil)
 	}
 	return
 }
@@ -69,7 +233,10 @@ func (sp *SerialPort) startCloseTimer() {
 
 // closeIdle closes the connection if last activity is passed behind IdleTimeout.
 func (sp *SerialPort) closeIdle() {
-	if sp.IdleTimeout <= 0 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if sp.IdleTimeout <= 0 || sp.port == nil {
 		return
 	}
 	idle := time.Now().Sub(sp.lastActivity)
@@ -80,63 +247,316 @@ func (sp *SerialPort) closeIdle() {
 }
 
 func (sp *SerialPort) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return sp.SendContext(context.Background(), aduRequest)
+}
+
+// SendContext sends the request and reads the answer. If ctx is done before the answer is read,
+// the transaction stops at the next read and the rest of the answer is dropped, the port is closed if the line does not get silent.
+func (sp *SerialPort) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
 	// Make sure port is connected
 	if err = sp.connect(); err != nil {
 		sp.Logger.Errorf("serial: can't connect: %s", err.Error())
 		return
 	}
-	// Start the timer to close when idle
-	sp.lastActivity = time.Now()
-	sp.startCloseTimer()
+	// Start the timer to close when idle after the transaction
+	defer func() {
+		sp.lastActivity = time.Now()
+		sp.startCloseTimer()
+	}()
+
+	// Wait for turnaround delay after the last broadcast
+	if err = SleepContext(ctx, time.Until(sp.quietUntil)); err != nil {
+		return
+	}
+
+	// reads return on every frame gap and check ctx, so the transaction stops soon after ctx is done
+	aduResponse, err = sp.exchange(ctx, aduRequest)
+
+	if err != nil && ctx.Err() != nil {
+		sp.Logger.Errorf("serial: transaction aborted: %s", ctx.Err().Error())
+		// drop the rest of the answer, the port is reopened only if it fails
+		if sp.port != nil {
+			if err := sp.drain(); err != nil {
+				sp.Logger.Errorf("serial: can't drain the port: %s", err.Error())
+				sp.close()
+			}
+		}
+		return nil, ctx.Err()
+	}
+
+	if err == nil && aduResponse != nil {
+		if err = sp.validate(aduRequest, aduResponse); err != nil {
+			sp.Logger.Errorf("serial: bad answer %s", err.Error())
+		}
+	}
+	return
+}
+
+// exchange drops stale input, sends the request, reads the echo if needed and the answer.
+func (sp *SerialPort) exchange(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	sp.drain()
 
-	// Send the request
 	sp.Logger.Debugf("serial: sending %x", aduRequest)
 	if _, err = sp.port.Write(aduRequest); err != nil {
-		sp.Logger.Errorf("serial: write error %s", err.Error())
+		err = sp.ioError("write", err)
 		return
 	}
-	function := aduRequest[1]
-	bytesToRead := calculateResponseLength(aduRequest)
-	time.Sleep(sp.calculateDelay(len(aduRequest) + bytesToRead))
 
-	var n int
-	var n1 int
-	var data [RtuMaxSize]byte
-	//We first read the minimum length and then read either the full package
-	//or the error package, depending on the error status (byte 2 of the response)
-	n, err = io.ReadAtLeast(sp.port, data[:], RtuMinSize)
-	if err != nil {
-		sp.Logger.Errorf("serial: read header error %s", err.Error())
+	if sp.EchoCancel {
+		if err = sp.readEcho(ctx, aduRequest); err != nil {
+			sp.Logger.Errorf("serial: echo error %s", err.Error())
+			return
+		}
+	}
+
+	// Nobody answers broadcast and force listen only
+	if sp.Mode.noAnswer(aduRequest) {
+		sp.quietUntil = time.Now().Add(sp.calculateDelay(len(aduRequest)) + sp.TurnaroundDelay)
 		return
 	}
-	//if the function is correct
-	if data[1] == function {
-		//we read the rest of the bytes
-		if n < bytesToRead {
-			if bytesToRead > RtuMinSize && bytesToRead <= RtuMaxSize {
-				if bytesToRead > n {
-					n1, err = io.ReadFull(sp.port, data[n:bytesToRead])
-					n += n1
-				}
-			}
+
+	if sp.Mode == ModeAscii {
+		return sp.readAscii(ctx)
+	}
+	return sp.readRtu(ctx, aduRequest)
+}
+
+// drain reads and drops everything in the input buffer, e.g. late answer to timed out request.
+// Driver read timeout is the frame gap, so it stops on the silence.
+// Error is returned if the line is not silent for the answer timeout or the read fails.
+func (sp *SerialPort) drain() error {
+	deadline := time.Now().Add(sp.Timeout)
+	var buf [RtuMaxSize]byte
+
+	for time.Now().Before(deadline) {
+		n, err := sp.port.Read(buf[:])
+		if n > 0 {
+			atomic.AddUint64(&sp.stats.StaleBytes, uint64(n))
+			sp.Logger.Warnf("serial: dropped stale input %x", buf[:n])
+		}
+		if err != nil && !isTimeout(err) {
+			return err
 		}
-	} else if data[1]&0x80 != 0 {
-		//for error we need to read 5 bytes
-		if n < RtuExceptionSize {
-			n1, err = io.ReadFull(sp.port, data[n:RtuExceptionSize])
+		if n == 0 || err != nil {
+			return nil
 		}
-		n += n1
 	}
+	return fmt.Errorf("no silence on the line for %v", sp.Timeout)
+}
 
+// validate checks that the answer is the answer to the request.
+func (sp *SerialPort) validate(aduRequest []byte, aduResponse []byte) error {
+	req, err := sp.Decode(aduRequest)
 	if err != nil {
-		sp.Logger.Errorf("serial: read error %s", err.Error())
+		return err
+	}
+
+	ans, err := sp.Decode(aduResponse)
+	if err != nil {
+		return err
+	}
+
+	return ValidateResponse(req, ans)
+}
+
+// readEcho reads back the sent request and checks it. Wrong echo means that somebody else
+// was transmitting at the same time.
+func (sp *SerialPort) readEcho(ctx context.Context, aduRequest []byte) error {
+	deadline := time.Now().Add(sp.calculateDelay(len(aduRequest)) + sp.Timeout)
+	echo := make([]byte, 0, len(aduRequest))
+	buf := make([]byte, len(aduRequest))
+
+	for len(echo) < len(aduRequest) {
+		n, err := sp.read(buf[:len(aduRequest)-len(echo)])
+		if err != nil {
+			return sp.ioError("echo read", err)
+		}
+		echo = append(echo, buf[:n]...)
+
+		if len(echo) < len(aduRequest) && time.Now().After(deadline) {
+			return fmt.Errorf("%w: got %d of %d echo bytes", ErrTimeout, len(echo), len(aduRequest))
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(echo, aduRequest) {
+		atomic.AddUint64(&sp.stats.EchoMismatches, 1)
+		return fmt.Errorf("%w: sent %x, got %x", ErrEchoMismatch, aduRequest, echo)
+	}
+	return nil
+}
+
+// readRtu reads rtu frame. The frame ends when the expected length is received,
+// or on t3.5 silence if the frame crc is valid, so answers to any function can be read.
+// Shorter silences (t1.5) can't be seen reliably from user space, so a silence with bad crc
+// is treated as a gap inside the frame and reading goes on until the timeout.
+func (sp *SerialPort) readRtu(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	chars := calculateResponseLength(aduRequest)
+	if !sp.EchoCancel {
+		// the request is still being sent
+		chars += len(aduRequest)
+	}
+	if err = SleepContext(ctx, sp.calculateDelay(chars)); err != nil {
 		return
 	}
-	aduResponse = data[:n]
+
+	deadline := time.Now().Add(sp.Timeout)
+	data := make([]byte, 0, RtuMaxSize)
+	var buf [RtuMaxSize]byte
+
+	for {
+		var n int
+		n, err = sp.read(buf[:RtuMaxSize-len(data)])
+		if err != nil {
+			err = sp.ioError("read", err)
+			return
+		}
+		data = append(data, buf[:n]...)
+
+		if l, ok := expectedResponseLength(aduRequest, data); ok && len(data) >= l {
+			data = data[:l]
+			break
+		}
+
+		// silence after the frame
+		if n == 0 && len(data) >= RtuMinSize && crcValid(data) {
+			break
+		}
+
+		if len(data) >= RtuMaxSize {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			if len(data) == 0 {
+				err = fmt.Errorf("%w: no answer in %v", ErrTimeout, sp.Timeout)
+				sp.Logger.Errorf("serial: read error %s", err.Error())
+				return
+			}
+			break
+		}
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+	}
+
+	aduResponse = data
 	sp.Logger.Debugf("serial: received %x", aduResponse)
 	return
 }
 
+// readAscii reads ascii frame, skipping everything before ':' and stopping at CRLF.
+func (sp *SerialPort) readAscii(ctx context.Context) (aduResponse []byte, err error) {
+	deadline := time.Now().Add(sp.Timeout)
+	data := make([]byte, 0, AsciiMaxSize)
+	var buf [AsciiMaxSize]byte
+
+	for {
+		var n int
+		n, err = sp.read(buf[:])
+		if err != nil {
+			err = sp.ioError("read", err)
+			return
+		}
+
+		for _, b := range buf[:n] {
+			switch {
+			case b == ':':
+				// start of the frame, drop everything before
+				data = append(data[:0], b)
+			case len(data) == 0:
+				// garbage before the frame
+				continue
+			default:
+				data = append(data, b)
+			}
+
+			if b == '\n' && len(data) > 1 && data[len(data)-2] == '\r' {
+				aduResponse = data
+				sp.Logger.Debugf("serial: received %q", aduResponse)
+				return
+			}
+
+			if len(data) >= AsciiMaxSize {
+				err = fmt.Errorf("%w: no ascii frame end in %d chars", ErrBadLength, len(data))
+				sp.Logger.Errorf("serial: read error %s", err.Error())
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("%w: no ascii frame in %v", ErrTimeout, sp.Timeout)
+			sp.Logger.Errorf("serial: read error %s", err.Error())
+			return
+		}
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+	}
+}
+
+// read reads from the port. Read timeout is not an error, it means silence on the line.
+// Zero bytes without timeout is the end of file: the device is gone, e.g. usb adapter is unplugged.
+func (sp *SerialPort) read(b []byte) (int, error) {
+	n, err := sp.port.Read(b)
+	if isTimeout(err) {
+		return n, nil
+	}
+	if n == 0 && err == nil && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// ioError closes the port after read or write error, the device may be gone.
+// The port is reopened on the next request.
+func (sp *SerialPort) ioError(op string, err error) error {
+	sp.Logger.Errorf("serial: %s error %s", op, err.Error())
+	sp.close()
+	sp.setState(PortReconnecting, err)
+	return err
+}
+
+// isTimeout returns true for read timeout of serial port or network connection, meaning silence on the line.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, serial.ErrTimeout) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// frameGap is t3.5, silent interval between frames.
+func (sp *SerialPort) frameGap() time.Duration {
+	return sp.calculateDelay(0)
+}
+
+// SleepContext pauses for d or until ctx is done, it returns ctx error in the latter case.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // calculateDelay roughly calculates time needed for the next frame.
 // See MODBUS over Serial Line - Specification and Implementation Guide (page 13).
 func (sp *SerialPort) calculateDelay(chars int) time.Duration {
@@ -163,10 +583,13 @@ func calculateResponseLength(adu []byte) int {
 			length++
 		}
 	case FuncCodeReadInputRegisters,
-		FuncCodeReadHoldingRegisters,
-		FuncCodeReadWriteMultipleRegisters:
+		FuncCodeReadHoldingRegisters:
 		count := int(binary.BigEndian.Uint16(adu[4:]))
 		length += 1 + count*2
+	case FuncCodeReadWriteMultipleRegisters:
+		// read address, read quantity, write address, write quantity...
+		readCount := int(binary.BigEndian.Uint16(adu[2+2:]))
+		length += 1 + readCount*2
 	case FuncCodeWriteSingleCoil,
 		FuncCodeWriteMultipleCoils,
 		FuncCodeWriteSingleRegister,
@@ -174,9 +597,77 @@ func calculateResponseLength(adu []byte) int {
 		length += 4
 	case FuncCodeMaskWriteRegister:
 		length += 6
-	case FuncCodeReadFIFOQueue:
-		// undetermined
+	case FuncCodeReadExceptionStatus:
+		length += 1
+	case FuncCodeGetComEventCounter:
+		length += 4
+	case FuncCodeWriteFileRecord,
+		FuncCodeDiagnostic:
+		// echo of the request, or the same size
+		length = len(adu)
+	case FuncCodeReadFIFOQueue,
+		FuncCodeReadFileRecord,
+		FuncCodeGetComEventLog,
+		FuncCodeReportSlaveId:
+		// undetermined, see responseLengthFromHeader
 	default:
 	}
 	return length
 }
+
+// expectedResponseLength returns full length of the response to the request, if it can be determined
+// from the request or from the response received so far.
+func expectedResponseLength(aduRequest []byte, data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+
+	if data[1] == aduRequest[1]|0x80 {
+		return RtuExceptionSize, true
+	}
+
+	if data[1] != aduRequest[1] {
+		return 0, false
+	}
+
+	if l, ok := responseLengthFromHeader(data); ok {
+		return l, true
+	}
+
+	switch aduRequest[1] {
+	case FuncCodeReadDiscreteInputs, FuncCodeReadCoils, FuncCodeReadInputRegisters, FuncCodeReadHoldingRegisters,
+		FuncCodeReadWriteMultipleRegisters, FuncCodeWriteSingleCoil, FuncCodeWriteMultipleCoils,
+		FuncCodeWriteSingleRegister, FuncCodeWriteMultipleRegisters, FuncCodeMaskWriteRegister,
+		FuncCodeWriteFileRecord, FuncCodeDiagnostic, FuncCodeReadExceptionStatus, FuncCodeGetComEventCounter:
+		return calculateResponseLength(aduRequest), true
+	default:
+		return 0, false
+	}
+}
+
+func crcValid(adu []byte) bool {
+	var crc crc
+	crc.reset().pushBytes(adu[:len(adu)-2])
+	return uint16(adu[len(adu)-1])<<8|uint16(adu[len(adu)-2]) == crc.value()
+}
+
+// responseLengthFromHeader returns full response length for functions with variable length responses,
+// using length field from the first RtuMinSize bytes of the response.
+func responseLengthFromHeader(header []byte) (int, bool) {
+	if len(header) < RtuMinSize {
+		return 0, false
+	}
+
+	switch header[1] {
+	case FuncCodeReadFileRecord,
+		FuncCodeGetComEventLog,
+		FuncCodeReportSlaveId:
+		// slave id, fn, byte count, data, crc (2)
+		return 3 + int(header[2]) + 2, true
+	case FuncCodeReadFIFOQueue:
+		// slave id, fn, byte count (2), data, crc (2)
+		return 4 + int(binary.BigEndian.Uint16(header[2:])) + 2, true
+	default:
+		return 0, false
+	}
+}
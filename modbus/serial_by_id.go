@@ -0,0 +1,33 @@
+package modbus
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// serialByIdDir has stable links to usb serial devices, named by vendor, model and serial number.
+var serialByIdDir = "/dev/serial/by-id"
+
+// SerialById returns stable /dev/serial/by-id/... path for the device, e.g. /dev/ttyUSB0.
+// USB adapter may get another device name after replug, the by-id link is kept.
+// The device is returned as is if there is no link to it.
+func SerialById(device string) string {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return device
+	}
+
+	entries, err := os.ReadDir(serialByIdDir)
+	if err != nil {
+		return device
+	}
+
+	for _, e := range entries {
+		link := filepath.Join(serialByIdDir, e.Name())
+		if t, err := filepath.EvalSymlinks(link); err == nil && t == target {
+			return link
+		}
+	}
+
+	return device
+}
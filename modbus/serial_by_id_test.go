@@ -0,0 +1,36 @@
+package modbus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSerialById(t *testing.T) {
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "ttyUSB0")
+	if err := os.WriteFile(dev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	serialByIdDir = filepath.Join(dir, "by-id")
+	defer func() { serialByIdDir = "/dev/serial/by-id" }()
+
+	if err := os.Mkdir(serialByIdDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(serialByIdDir, "usb-FTDI_FT232R_A1234-if00-port0")
+	if err := os.Symlink("../ttyUSB0", link); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := SerialById(dev); res != link {
+		t.Errorf("got %s, expected %s", res, link)
+	}
+
+	other := filepath.Join(dir, "ttyUSB1")
+	if res := SerialById(other); res != other {
+		t.Errorf("got %s, expected %s", res, other)
+	}
+}
@@ -0,0 +1,99 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ComEventLog is the answer to get comm event log request.
+type ComEventLog struct {
+	Status       uint16
+	EventCount   uint16
+	MessageCount uint16
+	Events       []byte
+}
+
+// SlaveIdReport is the answer to report slave id request.
+// Slave id length is device specific, most devices use one byte.
+type SlaveIdReport struct {
+	SlaveId      byte
+	RunIndicator bool
+	Additional   []byte
+}
+
+func ReadExceptionStatus(slaveId byte) *ProtocolDataUnit {
+	return &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReadExceptionStatus, Data: []byte{}}
+}
+
+func GetComEventCounter(slaveId byte) *ProtocolDataUnit {
+	return &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeGetComEventCounter, Data: []byte{}}
+}
+
+func GetComEventLog(slaveId byte) *ProtocolDataUnit {
+	return &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeGetComEventLog, Data: []byte{}}
+}
+
+func ReportSlaveId(slaveId byte) *ProtocolDataUnit {
+	return &ProtocolDataUnit{SlaveId: slaveId, FunctionCode: FuncCodeReportSlaveId, Data: []byte{}}
+}
+
+func DecodeExceptionStatus(pdu *ProtocolDataUnit) (byte, error) {
+	if pdu.FunctionCode != FuncCodeReadExceptionStatus {
+		return 0, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) != 1 {
+		return 0, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	return pdu.Data[0], nil
+}
+
+func DecodeComEventCounter(pdu *ProtocolDataUnit) (status uint16, count uint16, err error) {
+	if pdu.FunctionCode != FuncCodeGetComEventCounter {
+		err = fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+		return
+	}
+
+	if len(pdu.Data) != 4 {
+		err = fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+		return
+	}
+
+	status = binary.BigEndian.Uint16(pdu.Data)
+	count = binary.BigEndian.Uint16(pdu.Data[2:])
+	return
+}
+
+func DecodeComEventLog(pdu *ProtocolDataUnit) (*ComEventLog, error) {
+	if pdu.FunctionCode != FuncCodeGetComEventLog {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) < 7 || len(pdu.Data) != 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	return &ComEventLog{
+		Status:       binary.BigEndian.Uint16(pdu.Data[1:]),
+		EventCount:   binary.BigEndian.Uint16(pdu.Data[3:]),
+		MessageCount: binary.BigEndian.Uint16(pdu.Data[5:]),
+		Events:       pdu.Data[7:],
+	}, nil
+}
+
+func DecodeSlaveIdReport(pdu *ProtocolDataUnit) (*SlaveIdReport, error) {
+	if pdu.FunctionCode != FuncCodeReportSlaveId {
+		return nil, fmt.Errorf("wrong function %x in pdu", pdu.FunctionCode)
+	}
+
+	if len(pdu.Data) < 3 || len(pdu.Data) != 1+int(pdu.Data[0]) {
+		return nil, fmt.Errorf("%w: data length %d", ErrBadPayload, len(pdu.Data))
+	}
+
+	return &SlaveIdReport{
+		SlaveId:      pdu.Data[1],
+		RunIndicator: pdu.Data[2] == 0xff,
+		Additional:   pdu.Data[3:],
+	}, nil
+}
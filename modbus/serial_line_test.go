@@ -0,0 +1,48 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestSerialLineResponseLength(t *testing.T) {
+	for fn, l := range map[byte]int{FuncCodeReadExceptionStatus: 5, FuncCodeGetComEventCounter: 8} {
+		adu, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: fn}).MakeRtu()
+		if n := calculateResponseLength(adu); n != l {
+			t.Errorf("fn %d: expected length %d, got %d", fn, l, n)
+		}
+	}
+
+	for _, fn := range []byte{FuncCodeGetComEventLog, FuncCodeReportSlaveId} {
+		l, ok := responseLengthFromHeader([]byte{1, fn, 8, 0})
+		if !ok || l != 13 {
+			t.Errorf("fn %d: expected length 13, got %d", fn, l)
+		}
+	}
+}
+
+func TestDecodeComEventLog(t *testing.T) {
+	pdu := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeGetComEventLog,
+		Data: []byte{8, 0, 0, 1, 8, 1, 0x21, 0x20, 0}}
+
+	log, err := DecodeComEventLog(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if log.Status != 0 || log.EventCount != 0x108 || log.MessageCount != 0x121 || len(log.Events) != 2 || log.Events[0] != 0x20 {
+		t.Errorf("wrong log %v", log)
+	}
+}
+
+func TestDecodeSlaveIdReport(t *testing.T) {
+	pdu := &ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReportSlaveId, Data: []byte{4, 0x42, 0xff, 'a', 'b'}}
+
+	r, err := DecodeSlaveIdReport(pdu)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if r.SlaveId != 0x42 || !r.RunIndicator || string(r.Additional) != "ab" {
+		t.Errorf("wrong report %v", r)
+	}
+}
@@ -0,0 +1,572 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/goburrow/serial"
+)
+
+func TestResponseLengthFromHeader(t *testing.T) {
+	// fifo with 2 values: byte count 6
+	l, ok := responseLengthFromHeader([]byte{1, FuncCodeReadFIFOQueue, 0, 6})
+	if !ok || l != 12 {
+		t.Errorf("expected length 12, got %d", l)
+	}
+
+	if _, ok := responseLengthFromHeader([]byte{1, FuncCodeReadHoldingRegisters, 2, 0}); ok {
+		t.Errorf("length for fn 3 must be undetermined")
+	}
+}
+
+type fakePort struct {
+	bytes.Buffer
+	written []byte
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func TestBroadcast(t *testing.T) {
+	port := &fakePort{}
+	sp := NewSerial("fake", 19200, 8, "N", 1)
+	sp.Logger = zap.NewNop().Sugar()
+	sp.port = port
+	sp.IdleTimeout = 0
+
+	adu, _ := WriteSingleRegister(0, 1, 2).MakeRtu()
+
+	ans, err := sp.Send(adu)
+	if err != nil || ans != nil {
+		t.Fatalf("expected no answer, got %x, %v", ans, err)
+	}
+
+	if !bytes.Equal(port.written, adu) {
+		t.Errorf("wrong data written: %x", port.written)
+	}
+
+	if time.Until(sp.quietUntil) < sp.TurnaroundDelay/2 {
+		t.Errorf("no turnaround delay")
+	}
+}
+
+func TestForceListenOnly(t *testing.T) {
+	for _, mode := range []SerialMode{ModeRtu, ModeAscii} {
+		sp := newTestSerial(silentPort{})
+		sp.Mode = mode
+		adu, _ := mode.Encode(ForceListenOnly(1))
+
+		start := time.Now()
+		ans, err := sp.Send(adu)
+		if err != nil || ans != nil {
+			t.Fatalf("%s: expected no answer, got %x, %v", mode, ans, err)
+		}
+
+		if time.Since(start) >= sp.Timeout {
+			t.Errorf("%s: waited for the answer", mode)
+		}
+	}
+}
+
+// silentPort never answers, Read returns timeout after the frame gap as the serial driver does.
+type silentPort struct{}
+
+func (p silentPort) Read(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return 0, serial.ErrTimeout
+}
+
+func (p silentPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p silentPort) Close() error {
+	return nil
+}
+
+func TestSendContextCancel(t *testing.T) {
+	sp := NewSerial("fake", 19200, 8, "N", 1)
+	sp.Logger = zap.NewNop().Sugar()
+	sp.port = silentPort{}
+	sp.IdleTimeout = 0
+
+	adu, _ := ReadHoldingRegisters(1, 1, 2).MakeRtu()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := sp.SendContext(ctx, adu)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("transaction was not aborted in time")
+	}
+
+	// nothing is on the line, the port is kept open
+	if sp.port == nil {
+		t.Errorf("port must be open after abort")
+	}
+}
+
+// noisyPort is silent until noise is set, then Read returns garbage all the time.
+type noisyPort struct {
+	noise atomic.Bool
+}
+
+func (p *noisyPort) Read(b []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	if !p.noise.Load() || len(b) == 0 {
+		return 0, serial.ErrTimeout
+	}
+	b[0] = 0xff
+	return 1, nil
+}
+
+func (p *noisyPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *noisyPort) Close() error {
+	return nil
+}
+
+func TestSendContextCancelNoise(t *testing.T) {
+	port := &noisyPort{}
+	sp := newTestSerial(port)
+	sp.Timeout = 50 * time.Millisecond
+
+	adu, _ := ReadHoldingRegisters(1, 1, 2).MakeRtu()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(10*time.Millisecond, func() {
+		port.noise.Store(true)
+		cancel()
+	})
+
+	if _, err := sp.SendContext(ctx, adu); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancel, got %v", err)
+	}
+
+	// line is not silent after abort, the port is reopened
+	if sp.port != nil {
+		t.Errorf("port must be closed after abort")
+	}
+}
+
+// chunkPort returns chunks one by one after the request is written, empty chunk or no chunks mean silence (timeout).
+type chunkPort struct {
+	chunks  [][]byte
+	written []byte
+	mutex   sync.Mutex
+}
+
+func (p *chunkPort) Read(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// nothing is on the line before the request
+	if len(p.written) == 0 || len(p.chunks) == 0 || len(p.chunks[0]) == 0 {
+		if len(p.written) == 0 {
+			return 0, serial.ErrTimeout
+		}
+		if len(p.chunks) > 0 {
+			p.chunks = p.chunks[1:]
+		}
+		p.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		p.mutex.Lock()
+		return 0, serial.ErrTimeout
+	}
+
+	n := copy(b, p.chunks[0])
+	p.chunks[0] = p.chunks[0][n:]
+	if len(p.chunks[0]) == 0 {
+		p.chunks = p.chunks[1:]
+	}
+	return n, nil
+}
+
+func (p *chunkPort) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.written = append(p.written, b...)
+	return len(b), nil
+}
+
+func (p *chunkPort) Close() error {
+	return nil
+}
+
+func newTestSerial(port io.ReadWriteCloser) *SerialPort {
+	sp := NewSerial("fake", 19200, 8, "N", 1)
+	sp.Logger = zap.NewNop().Sugar()
+	sp.port = port
+	sp.IdleTimeout = 0
+	sp.Timeout = 100 * time.Millisecond
+	return sp
+}
+
+func TestReadUserDefinedFunction(t *testing.T) {
+	ans, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: 0x41, Data: []byte{1, 2, 3, 4, 5, 6}}).MakeRtu()
+
+	// answer comes in two parts with a gap inside
+	sp := newTestSerial(&chunkPort{chunks: [][]byte{{}, ans[:3], {}, ans[3:]}})
+
+	req, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: 0x41, Data: []byte{9}}).MakeRtu()
+	res, err := sp.Send(req)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if !bytes.Equal(res, ans) {
+		t.Errorf("got %x, expected %x", res, ans)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	sp := newTestSerial(&chunkPort{})
+
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	if _, err := sp.Send(req); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestReadException(t *testing.T) {
+	ans, _ := NewModbusError(ReadHoldingRegisters(1, 0, 1), ExceptionCodeIllegalDataAddress).MakeRtu()
+	sp := newTestSerial(&chunkPort{chunks: [][]byte{ans}})
+
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	res, err := sp.Send(req)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if !bytes.Equal(res, ans) {
+		t.Errorf("got %x, expected %x", res, ans)
+	}
+}
+
+func TestEchoCancel(t *testing.T) {
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	ans, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0, 5}}).MakeRtu()
+
+	sp := newTestSerial(&chunkPort{chunks: [][]byte{req, {}, ans}})
+	sp.EchoCancel = true
+
+	res, err := sp.Send(req)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if !bytes.Equal(res, ans) {
+		t.Errorf("got %x, expected %x", res, ans)
+	}
+
+	if n := sp.Stats().EchoMismatches; n != 0 {
+		t.Errorf("got %d echo mismatches", n)
+	}
+}
+
+func TestEchoMismatch(t *testing.T) {
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	echo := append([]byte{}, req...)
+	echo[3] ^= 0xff
+
+	sp := newTestSerial(&chunkPort{chunks: [][]byte{echo}})
+	sp.EchoCancel = true
+
+	if _, err := sp.Send(req); !errors.Is(err, ErrEchoMismatch) {
+		t.Errorf("expected ErrEchoMismatch, got %v", err)
+	}
+
+	if n := sp.Stats().EchoMismatches; n != 1 {
+		t.Errorf("got %d echo mismatches, expected 1", n)
+	}
+}
+
+func TestStaleInputDropped(t *testing.T) {
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	stale, _ := (&ProtocolDataUnit{SlaveId: 2, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0, 7}}).MakeRtu()
+	ans, _ := (&ProtocolDataUnit{SlaveId: 1, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0, 5}}).MakeRtu()
+
+	port := &chunkPort{chunks: [][]byte{ans}}
+	sp := newTestSerial(&stalePort{chunkPort: port, stale: stale})
+
+	res, err := sp.Send(req)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if !bytes.Equal(res, ans) {
+		t.Errorf("got %x, expected %x", res, ans)
+	}
+
+	if n := sp.Stats().StaleBytes; n != uint64(len(stale)) {
+		t.Errorf("got %d stale bytes, expected %d", n, len(stale))
+	}
+}
+
+func TestWrongSlaveAnswer(t *testing.T) {
+	req, _ := ReadHoldingRegisters(1, 0, 1).MakeRtu()
+	ans, _ := (&ProtocolDataUnit{SlaveId: 2, FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{2, 0, 5}}).MakeRtu()
+
+	sp := newTestSerial(&chunkPort{chunks: [][]byte{ans}})
+
+	if _, err := sp.Send(req); !errors.Is(err, ErrBadSlaveId) {
+		t.Errorf("expected ErrBadSlaveId, got %v", err)
+	}
+}
+
+// stalePort has late answer to the previous request in the input buffer.
+type stalePort struct {
+	*chunkPort
+	stale []byte
+}
+
+func (p *stalePort) Read(b []byte) (int, error) {
+	if len(p.stale) > 0 {
+		n := copy(b, p.stale)
+		p.stale = p.stale[n:]
+		return n, nil
+	}
+	return p.chunkPort.Read(b)
+}
+
+// memPort answers every rtu read holding registers request with register values equal to the address.
+// memPortSilentAddr is register address memPort does not answer for.
+const memPortSilentAddr = 0xffff
+
+type memPort struct {
+	mutex  sync.Mutex
+	input  []byte
+	closed bool
+}
+
+func (p *memPort) Read(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if len(p.input) == 0 {
+		p.mutex.Unlock()
+		time.Sleep(100 * time.Microsecond)
+		p.mutex.Lock()
+		return 0, serial.ErrTimeout
+	}
+
+	n := copy(b, p.input)
+	p.input = p.input[n:]
+	return n, nil
+}
+
+func (p *memPort) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	req, err := FromRtu(b)
+	if err != nil {
+		return 0, err
+	}
+
+	addr := binary.BigEndian.Uint16(req.Data)
+	if addr == memPortSilentAddr {
+		return len(b), nil
+	}
+
+	ans := &ProtocolDataUnit{SlaveId: req.SlaveId, FunctionCode: req.FunctionCode, Data: []byte{2, 0, 0}}
+	binary.BigEndian.PutUint16(ans.Data[1:], addr)
+	adu, _ := ans.MakeRtu()
+	p.input = append(p.input, adu...)
+	return len(b), nil
+}
+
+func (p *memPort) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+func TestSerialStress(t *testing.T) {
+	sp := NewSerial("mem", 115200, 8, "N", 1)
+	sp.Logger = zap.NewNop().Sugar()
+	sp.IdleTimeout = time.Millisecond
+	sp.open = func() (io.ReadWriteCloser, error) {
+		return &memPort{}, nil
+	}
+
+	done := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(3 * time.Millisecond):
+				sp.Close()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				addr := uint16(i*100 + j)
+				if j%10 == 9 {
+					// aborted transaction, cancelled while waiting for the answer
+					addr = memPortSilentAddr
+				}
+				req, _ := ReadHoldingRegisters(1, addr, 1).MakeRtu()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				if addr == memPortSilentAddr {
+					time.AfterFunc(2*time.Millisecond, cancel)
+				}
+				res, err := sp.SendContext(ctx, req)
+				cancel()
+
+				if addr == memPortSilentAddr {
+					if !errors.Is(err, context.Canceled) {
+						t.Errorf("expected cancel, got %v", err)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Errorf("error %v", err)
+					return
+				}
+
+				pdu, _ := FromRtu(res)
+				if vals, err := DecodeValues(pdu); err != nil || vals[0] != addr {
+					t.Errorf("wrong answer %x for address %d", res, addr)
+					return
+				}
+
+				if j%7 == 0 {
+					sp.Close()
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(done)
+	<-closed
+
+	if err := sp.Close(); err != nil {
+		t.Errorf("close error %v", err)
+	}
+}
+
+// unpluggedPort is usb adapter after unplug: read returns nothing without timeout, write fails.
+type unpluggedPort struct{}
+
+func (p unpluggedPort) Read(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (p unpluggedPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p unpluggedPort) Close() error {
+	return nil
+}
+
+func TestReconnect(t *testing.T) {
+	sp := NewSerial("mem", 115200, 8, "N", 1)
+	sp.Logger = zap.NewNop().Sugar()
+	sp.IdleTimeout = 0
+	sp.ReconnectDelay = 20 * time.Millisecond
+	sp.port = unpluggedPort{}
+
+	fails := 2
+	sp.open = func() (io.ReadWriteCloser, error) {
+		if fails > 0 {
+			fails--
+			return nil, fmt.Errorf("no such device")
+		}
+		return &memPort{}, nil
+	}
+
+	req, _ := ReadHoldingRegisters(1, 5, 1).MakeRtu()
+
+	// eof from the unplugged device
+	if _, err := sp.Send(req); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected eof, got %v", err)
+	}
+
+	if st := sp.Status(); st.State != PortReconnecting || st.LastError == "" {
+		t.Errorf("wrong status %+v", st)
+	}
+
+	// open fails, the next attempt is after the delay
+	if _, err := sp.Send(req); !errors.Is(err, ErrNotConnected) || !strings.Contains(err.Error(), "no such device") {
+		t.Fatalf("expected open error, got %v", err)
+	}
+
+	if _, err := sp.Send(req); !errors.Is(err, ErrNotConnected) || !strings.Contains(err.Error(), "next attempt") {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	time.Sleep(sp.ReconnectDelay)
+
+	// open fails again, the delay is doubled
+	if _, err := sp.Send(req); !errors.Is(err, ErrNotConnected) || !strings.Contains(err.Error(), "no such device") {
+		t.Fatalf("expected open error, got %v", err)
+	}
+
+	time.Sleep(sp.ReconnectDelay)
+
+	if _, err := sp.Send(req); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	time.Sleep(sp.ReconnectDelay)
+
+	if _, err := sp.Send(req); err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	if st := sp.Status(); st.State != PortOpen {
+		t.Errorf("wrong state %s", st.State)
+	}
+}
@@ -0,0 +1,47 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// TcpFrameReader reads modbus tcp frames one by one from a stream,
+// so several frames in one segment or one frame split across segments are handled.
+type TcpFrameReader struct {
+	r *bufio.Reader
+}
+
+func NewTcpFrameReader(r io.Reader) *TcpFrameReader {
+	return &TcpFrameReader{r: bufio.NewReaderSize(r, TcpMaxLength)}
+}
+
+// ReadFrame reads exactly one adu: mbap header and length-1 bytes of pdu.
+// Header errors mean the stream is out of sync and the connection should be dropped.
+func (t *TcpFrameReader) ReadFrame() ([]byte, error) {
+	header := make([]byte, TcpHeaderSize, TcpMaxLength)
+
+	if _, err := io.ReadFull(t.r, header); err != nil {
+		return nil, err
+	}
+
+	if protocolId := binary.BigEndian.Uint16(header[2:]); protocolId != 0 {
+		return nil, fmt.Errorf("%w: %d", ErrBadProtocolID, protocolId)
+	}
+
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || length > TcpMaxLength-TcpHeaderSize+1 {
+		return nil, fmt.Errorf("%w: length in header %d", ErrBadLength, length)
+	}
+
+	adu := header[:TcpHeaderSize+length-1]
+	if _, err := io.ReadFull(t.r, adu[TcpHeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return adu, nil
+}
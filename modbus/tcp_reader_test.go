@@ -0,0 +1,55 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTcpFrameReaderPipelined(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(ReadHoldingRegisters(1, 10, 2).MakeTCP(1))
+	buf.Write(WriteMultipleRegisters(2, 10, 3, []uint16{1, 2, 3}).MakeTCP(2))
+	buf.Write(ReadCoils(3, 0, 8).MakeTCP(3))
+
+	r := NewTcpFrameReader(iotest.OneByteReader(&buf))
+
+	for i, fn := range []byte{FuncCodeReadHoldingRegisters, FuncCodeWriteMultipleRegisters, FuncCodeReadCoils} {
+		adu, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: error %v", i, err)
+		}
+
+		trId, pdu, err := FromTCP(adu)
+		if err != nil {
+			t.Fatalf("frame %d: error %v", i, err)
+		}
+
+		if trId != uint16(i+1) || pdu.SlaveId != byte(i+1) || pdu.FunctionCode != fn {
+			t.Errorf("frame %d: bad pdu %v", i, pdu)
+		}
+	}
+
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestTcpFrameReaderErrors(t *testing.T) {
+	r := NewTcpFrameReader(bytes.NewReader([]byte{0, 1, 0, 1, 0, 6, 1, 3}))
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrBadProtocolID) {
+		t.Errorf("expected ErrBadProtocolID, got %v", err)
+	}
+
+	r = NewTcpFrameReader(bytes.NewReader([]byte{0, 1, 0, 0, 0x10, 0, 1, 3}))
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrBadLength) {
+		t.Errorf("expected ErrBadLength, got %v", err)
+	}
+
+	r = NewTcpFrameReader(bytes.NewReader([]byte{0, 1, 0, 0, 0, 6, 1, 3}))
+	if _, err := r.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	upstreamTimeout = time.Second
+	upstreamMaxIdle = 2
+)
+
+// TcpUpstream is modbus tcp server used as a bus, e.g. plc or another gateway.
+// Transaction ids are replaced with own ones, unit ids are rewritten by UnitMap.
+// Connections are kept open and reused, so several transactions can go at the same time.
+type TcpUpstream struct {
+	Addr    string
+	Timeout time.Duration
+	// UnitMap maps unit ids of requests to unit ids of the upstream
+	UnitMap map[byte]byte
+	// MaxIdle is the number of idle connections kept open
+	MaxIdle int
+	Logger  *zap.SugaredLogger
+	trId    uint32
+	mutex   sync.Mutex
+	idle    []*upstreamConn
+}
+
+type upstreamConn struct {
+	net.Conn
+	reader *TcpFrameReader
+}
+
+func NewTcpUpstream(addr string) *TcpUpstream {
+	return &TcpUpstream{
+		Addr:    addr,
+		Timeout: upstreamTimeout,
+		UnitMap: make(map[byte]byte),
+		MaxIdle: upstreamMaxIdle,
+		Logger:  zap.NewNop().Sugar(),
+	}
+}
+
+func (t *TcpUpstream) Encode(pdu *ProtocolDataUnit) ([]byte, error) {
+	return pdu.MakeTCP(0), nil
+}
+
+func (t *TcpUpstream) Decode(adu []byte) (*ProtocolDataUnit, error) {
+	_, pdu, err := FromTCPResponse(adu)
+	return pdu, err
+}
+
+// SendContext sends the request to the upstream. The answer has transaction and unit ids of the request.
+func (t *TcpUpstream) SendContext(ctx context.Context, adu []byte) ([]byte, error) {
+	if len(adu) < TcpHeaderSize+1 {
+		return nil, fmt.Errorf("%w: tcp frame length %d", ErrShortFrame, len(adu))
+	}
+
+	req := append([]byte{}, adu...)
+	if u, ok := t.UnitMap[adu[6]]; ok {
+		req[6] = u
+	}
+	trId := uint16(atomic.AddUint32(&t.trId, 1))
+	binary.BigEndian.PutUint16(req, trId)
+
+	// request that can't be parsed is not resent too
+	_, pdu, _ := FromTCP(adu)
+	modifies := pdu == nil || ModifiesState(pdu)
+
+	var res []byte
+	for {
+		conn, reused, err := t.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var sent bool
+		res, sent, err = t.exchange(ctx, conn, req)
+		if err == nil {
+			if ansId := binary.BigEndian.Uint16(res); ansId != trId {
+				// late answer to the earlier request, the next one could be late too
+				conn.Close()
+				err = fmt.Errorf("upstream %s: transaction id mismatch: sent %d, got %d", t.Addr, trId, ansId)
+				t.Logger.Error(err.Error())
+				return nil, err
+			}
+			t.put(conn)
+			break
+		}
+
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// idle connection may be closed by the upstream, try the next one,
+		// but not if the state changing request is sent, the upstream could execute it
+		if reused && !isTimeout(err) && (!sent || !modifies) {
+			continue
+		}
+		if isTimeout(err) {
+			err = fmt.Errorf("%w: upstream %s: %s", ErrTimeout, t.Addr, err.Error())
+		}
+		t.Logger.Errorf("upstream %s: %s", t.Addr, err.Error())
+		return nil, err
+	}
+
+	copy(res, adu[:2])
+	res[6] = adu[6]
+	return res, nil
+}
+
+// exchange sends the request and reads the answer, sent is true if the request is written.
+func (t *TcpUpstream) exchange(ctx context.Context, conn *upstreamConn, req []byte) (res []byte, sent bool, err error) {
+	deadline := time.Now().Add(t.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, false, err
+	}
+
+	// break i/o if ctx is done before the deadline
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	t.Logger.Debugf("upstream %s: sending %x", t.Addr, req)
+	if _, err = conn.Write(req); err != nil {
+		return nil, false, err
+	}
+
+	if res, err = conn.reader.ReadFrame(); err != nil {
+		return nil, true, err
+	}
+	t.Logger.Debugf("upstream %s: received %x", t.Addr, res)
+	return res, true, nil
+}
+
+// get returns idle connection or makes the new one, reused is true for idle one.
+func (t *TcpUpstream) get(ctx context.Context) (conn *upstreamConn, reused bool, err error) {
+	t.mutex.Lock()
+	if n := len(t.idle); n > 0 {
+		conn = t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mutex.Unlock()
+		return conn, true, nil
+	}
+	t.mutex.Unlock()
+
+	d := net.Dialer{Timeout: t.Timeout}
+	c, err := d.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		t.Logger.Errorf("upstream %s: can't connect: %s", t.Addr, err.Error())
+		return nil, false, fmt.Errorf("%w: upstream %s: %s", ErrNotConnected, t.Addr, err.Error())
+	}
+	return &upstreamConn{Conn: c, reader: NewTcpFrameReader(c)}, false, nil
+}
+
+// put returns the connection to the idle ones, or closes it if there are enough.
+func (t *TcpUpstream) put(conn *upstreamConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.idle) < t.MaxIdle {
+		t.idle = append(t.idle, conn)
+		return
+	}
+	conn.Close()
+}
+
+// Close closes idle connections.
+func (t *TcpUpstream) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, c := range t.idle {
+		c.Close()
+	}
+	t.idle = nil
+	return nil
+}
+
+func (t *TcpUpstream) String() string {
+	return "tcp " + t.Addr
+}
@@ -0,0 +1,215 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpServer is modbus tcp server stand-in, it answers read holding registers with unit id and the address.
+// Unit 99 never answers, unit 98 gets the answer with wrong transaction id.
+func tcpServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := NewTcpFrameReader(conn)
+
+				for {
+					frame, err := reader.ReadFrame()
+					if err != nil {
+						return
+					}
+
+					trId, pdu, _ := FromTCP(frame)
+					if pdu.SlaveId == 99 {
+						continue
+					}
+
+					if pdu.SlaveId == 98 {
+						trId++
+					}
+
+					ans := &ProtocolDataUnit{SlaveId: pdu.SlaveId, FunctionCode: pdu.FunctionCode, Data: []byte{4, 0, pdu.SlaveId, pdu.Data[0], pdu.Data[1]}}
+					if _, err := conn.Write(ans.MakeTCP(trId)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestTcpUpstream(t *testing.T) {
+	up := NewTcpUpstream(tcpServer(t))
+	up.UnitMap[1] = 7
+	defer up.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				addr := uint16(i*100 + j)
+				adu := ReadHoldingRegisters(1, addr, 2).MakeTCP(addr)
+
+				res, err := up.SendContext(context.Background(), adu)
+				if err != nil {
+					t.Errorf("error %v", err)
+					return
+				}
+
+				trId, pdu, err := FromTCPResponse(res)
+				if err != nil || trId != addr || pdu.SlaveId != 1 {
+					t.Errorf("wrong answer %x to %x", res, adu)
+					return
+				}
+
+				// upstream got mapped unit id
+				if vals, _ := DecodeValues(pdu); vals[0] != 7 || vals[1] != addr {
+					t.Errorf("wrong values %v", vals)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(up.idle); n == 0 || n > up.MaxIdle {
+		t.Errorf("got %d idle connections", n)
+	}
+}
+
+func TestTcpUpstreamTimeout(t *testing.T) {
+	up := NewTcpUpstream(tcpServer(t))
+	up.Timeout = 50 * time.Millisecond
+	defer up.Close()
+
+	start := time.Now()
+	if _, err := up.SendContext(context.Background(), ReadHoldingRegisters(99, 0, 1).MakeTCP(1)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("no timeout")
+	}
+
+	// broken connection is not reused
+	if len(up.idle) != 0 {
+		t.Errorf("got %d idle connections", len(up.idle))
+	}
+}
+
+func TestTcpUpstreamWrongTransactionId(t *testing.T) {
+	up := NewTcpUpstream(tcpServer(t))
+	defer up.Close()
+
+	if _, err := up.SendContext(context.Background(), ReadHoldingRegisters(98, 0, 1).MakeTCP(1)); err == nil {
+		t.Errorf("expected error")
+	}
+
+	// connection with late answers is not reused
+	if len(up.idle) != 0 {
+		t.Errorf("got %d idle connections", len(up.idle))
+	}
+}
+
+// droppingServer answers the first request on every connection and closes the connection after the next one,
+// requests counts all requests.
+func droppingServer(t *testing.T, requests *int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := NewTcpFrameReader(conn)
+
+				frame, err := reader.ReadFrame()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(requests, 1)
+
+				trId, pdu, _ := FromTCP(frame)
+				if _, err := conn.Write(WriteResponse(pdu).MakeTCP(trId)); err != nil {
+					return
+				}
+
+				if _, err := reader.ReadFrame(); err == nil {
+					atomic.AddInt32(requests, 1)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestTcpUpstreamNoWriteResend(t *testing.T) {
+	for _, pdu := range []*ProtocolDataUnit{
+		WriteSingleRegister(1, 0, 2),
+		ReadWriteMultipleRegisters(1, 0, 1, 0, []uint16{2}),
+	} {
+		var requests int32
+		up := NewTcpUpstream(droppingServer(t, &requests))
+
+		// the second request goes to the idle connection, the upstream drops it after the request is read
+		if _, err := up.SendContext(context.Background(), WriteSingleRegister(1, 0, 1).MakeTCP(1)); err != nil {
+			t.Fatalf("error %v", err)
+		}
+
+		if _, err := up.SendContext(context.Background(), pdu.MakeTCP(2)); err == nil {
+			t.Errorf("fn %d: expected error", pdu.FunctionCode)
+		}
+
+		// give the server time to count the request
+		time.Sleep(10 * time.Millisecond)
+		if n := atomic.LoadInt32(&requests); n != 2 {
+			t.Errorf("fn %d: upstream got %d requests, expected 2", pdu.FunctionCode, n)
+		}
+		up.Close()
+	}
+}
+
+func TestTcpUpstreamNotConnected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	up := NewTcpUpstream(addr)
+	if _, err := up.SendContext(context.Background(), ReadHoldingRegisters(1, 0, 1).MakeTCP(1)); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+}
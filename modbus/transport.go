@@ -0,0 +1,113 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+)
+
+// Transport is the bus the gateway sends requests to.
+type Transport interface {
+	// Encode makes adu for the pdu in the transport framing
+	Encode(pdu *ProtocolDataUnit) ([]byte, error)
+	// Decode parses adu in the transport framing
+	Decode(adu []byte) (*ProtocolDataUnit, error)
+	// SendContext sends the request adu and receives the answer adu.
+	// Broadcast and force listen only requests get nil answer.
+	SendContext(ctx context.Context, adu []byte) ([]byte, error)
+	Close() error
+}
+
+type SerialMode int
+
+const (
+	ModeRtu SerialMode = iota
+	ModeAscii
+)
+
+func (m SerialMode) String() string {
+	if m == ModeAscii {
+		return "ascii"
+	}
+	return "rtu"
+}
+
+func (m SerialMode) Encode(pdu *ProtocolDataUnit) ([]byte, error) {
+	if m == ModeAscii {
+		return pdu.MakeAscii()
+	}
+	return pdu.MakeRtu()
+}
+
+func (m SerialMode) Decode(adu []byte) (*ProtocolDataUnit, error) {
+	if m == ModeAscii {
+		return FromAscii(adu)
+	}
+	return FromRtu(adu)
+}
+
+func (m SerialMode) isBroadcast(adu []byte) bool {
+	if m == ModeAscii {
+		return len(adu) > 2 && adu[1] == '0' && adu[2] == '0'
+	}
+	return len(adu) > 0 && adu[0] == 0
+}
+
+// noAnswer returns true for requests nobody answers: broadcast and force listen only.
+func (m SerialMode) noAnswer(adu []byte) bool {
+	if m.isBroadcast(adu) {
+		return true
+	}
+
+	pdu, err := m.Decode(adu)
+	return err == nil && IsForceListenOnly(pdu)
+}
+
+// PipeTransport is in-memory transport, requests are answered by Handler.
+// Nil answer from the handler means the slave does not respond.
+type PipeTransport struct {
+	Mode    SerialMode
+	Handler func(pdu *ProtocolDataUnit) *ProtocolDataUnit
+}
+
+func NewPipe(handler func(pdu *ProtocolDataUnit) *ProtocolDataUnit) *PipeTransport {
+	return &PipeTransport{Handler: handler}
+}
+
+func (p *PipeTransport) Encode(pdu *ProtocolDataUnit) ([]byte, error) {
+	return p.Mode.Encode(pdu)
+}
+
+func (p *PipeTransport) Decode(adu []byte) (*ProtocolDataUnit, error) {
+	return p.Mode.Decode(adu)
+}
+
+func (p *PipeTransport) SendContext(ctx context.Context, adu []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	req, err := p.Decode(adu)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := p.Handler(req)
+
+	if p.Mode.noAnswer(adu) {
+		return nil, nil
+	}
+
+	if ans == nil {
+		return nil, fmt.Errorf("%w: pipe: no answer from slave %d", ErrTimeout, req.SlaveId)
+	}
+
+	return p.Encode(ans)
+}
+
+func (p *PipeTransport) Close() error {
+	return nil
+}
+
+func (p *PipeTransport) String() string {
+	return "pipe " + p.Mode.String()
+}